@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleFindDuplicates(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	// The version comes from the same read as the groups, so merging with it
+	// as expectedVersion fails if the groups went stale.
+	groups, version, err := d.store.FindDuplicates(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	results := make([]map[string]any, 0, len(groups))
+	for _, group := range groups {
+		nodes := make([]map[string]any, 0, len(group.NodeIDs))
+		for _, id := range group.NodeIDs {
+			// A write between the two reads may have deleted the node; the
+			// stale version then rejects any merge of its group anyway.
+			node, ok := tree.Nodes[id]
+			if !ok {
+				continue
+			}
+			summary := nodeSummary(node)
+			summary["createdAt"] = node.CreatedAt
+			summary["folder"] = folderPath(tree, node)
+			nodes = append(nodes, summary)
+		}
+		if len(nodes) < 2 {
+			continue
+		}
+		results = append(results, map[string]any{
+			"canonicalUrl": group.CanonicalURL,
+			"nodes":        nodes,
+		})
+	}
+	return map[string]any{"groups": results, "version": version}, nil
+}
+
+// folderPath returns the path of the folder holding node.
+func folderPath(tree core.Tree, node core.Node) string {
+	if node.ParentID == nil {
+		return ""
+	}
+	return core.NodePath(tree, *node.ParentID)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+	"github.com/rexliu/s0f/pkg/storage/sqlite"
+)
+
+// maxFaviconURLs caps how many URLs one get_favicons call may look up.
+const maxFaviconURLs = 500
+
+func (d *daemon) handlePutFavicon(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		// URL is any page on the icon's origin, or the origin itself.
+		URL         string `json:"url"`
+		ContentType string `json:"contentType"`
+		// Data is the image, base64-encoded on the wire.
+		Data      []byte `json:"data"`
+		FetchedAt int64  `json:"fetchedAt"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || req.URL == "" {
+		return nil, ipc.Errorf("INVALID_REQUEST", "url required", nil)
+	}
+	if req.FetchedAt == 0 {
+		req.FetchedAt = time.Now().UnixMilli()
+	}
+	icon, err := d.cache.PutFavicon(ctx, sqlite.Favicon{
+		Origin:      req.URL,
+		ContentType: req.ContentType,
+		Data:        req.Data,
+		FetchedAt:   req.FetchedAt,
+	})
+	switch {
+	case errors.Is(err, core.ErrInvalidURL):
+		return nil, ipc.Errorf("INVALID_REQUEST", "url has no origin", map[string]any{"url": req.URL})
+	case errors.Is(err, sqlite.ErrInvalidFavicon):
+		return nil, ipc.Errorf("INVALID_REQUEST", err.Error(), map[string]any{"contentType": req.ContentType, "size": len(req.Data), "maxSize": sqlite.MaxFaviconSize})
+	case err != nil:
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	return map[string]any{"origin": icon.Origin, "fetchedAt": icon.FetchedAt}, nil
+}
+
+func (d *daemon) handleGetFavicons(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, ipc.Errorf("INVALID_REQUEST", "invalid get_favicons params", nil)
+	}
+	if len(req.URLs) > maxFaviconURLs {
+		return nil, ipc.Errorf("INVALID_REQUEST", "too many urls", map[string]any{"max": maxFaviconURLs})
+	}
+	// Icons are returned once per origin; origins maps each requested URL to
+	// the icon it uses. URLs without an origin, such as bookmarklets, and
+	// origins without an icon are left out.
+	originOf := make(map[string]string, len(req.URLs))
+	var origins []string
+	seen := make(map[string]bool)
+	for _, raw := range req.URLs {
+		origin, err := core.URLOrigin(raw)
+		if err != nil {
+			continue
+		}
+		originOf[raw] = origin
+		if !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	icons, err := d.cache.Favicons(ctx, origins)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	for raw, origin := range originOf {
+		if _, ok := icons[origin]; !ok {
+			delete(originOf, raw)
+		}
+	}
+	return map[string]any{"favicons": icons, "origins": originOf}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+	"github.com/rexliu/s0f/pkg/storage/sqlite"
+)
+
+func (d *daemon) handleUndo(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	req, rpcErr := parseHistoryParams(params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, err := d.store.NextUndo(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	if entry == nil {
+		return nil, ipc.Errorf("NOTHING_TO_UNDO", "no batch to undo", nil)
+	}
+	return d.replayHistory(ctx, "undo", req, entry.Inverse, func(opts sqlite.ApplyOptions) (sqlite.ApplyResult, error) {
+		return d.store.Undo(ctx, *entry, opts)
+	})
+}
+
+func (d *daemon) handleRedo(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	req, rpcErr := parseHistoryParams(params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, err := d.store.NextRedo(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	if entry == nil {
+		return nil, ipc.Errorf("NOTHING_TO_REDO", "no batch to redo", nil)
+	}
+	return d.replayHistory(ctx, "redo", req, entry.Ops, func(opts sqlite.ApplyOptions) (sqlite.ApplyResult, error) {
+		return d.store.Redo(ctx, *entry, opts)
+	})
+}
+
+type historyParams struct {
+	Client          string  `json:"client"`
+	ExpectedVersion *string `json:"expectedVersion,omitempty"`
+}
+
+// parseHistoryParams reads the optional undo/redo params.
+func parseHistoryParams(params json.RawMessage) (historyParams, *ipc.Error) {
+	var req historyParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &req); err != nil {
+			return historyParams{}, ipc.Errorf("INVALID_REQUEST", "invalid params", nil)
+		}
+	}
+	return req, nil
+}
+
+// replayHistory validates a history batch against the current tree, applies
+// it, and commits the result like any other batch. Callers hold d.mu.
+func (d *daemon) replayHistory(ctx context.Context, verb string, req historyParams, ops []core.Op, apply func(sqlite.ApplyOptions) (sqlite.ApplyResult, error)) (any, *ipc.Error) {
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	if rpcErr := checkVersion(req.ExpectedVersion, tree); rpcErr != nil {
+		return nil, rpcErr
+	}
+	// Changes made outside apply_ops, such as emptying the trash, can leave
+	// a history batch referring to nodes that no longer exist.
+	if err := core.ValidateOps(tree, ops, d.cfg.ValidationPolicy()); err != nil {
+		return nil, validationError(err)
+	}
+	result, err := apply(sqlite.ApplyOptions{Client: req.Client})
+	if err != nil {
+		return nil, storageError(err)
+	}
+	message := fmt.Sprintf("%s %d ops", verb, len(ops))
+	if len(ops) > 0 {
+		message += ": " + core.OpType(ops[0])
+	}
+	updated, status := d.commitTree(ctx, result.Tree, message)
+	return map[string]any{
+		"tree":      updated,
+		"vcsStatus": status,
+		"batchId":   result.BatchID,
+	}, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -55,7 +56,9 @@ func main() {
 }
 
 type daemon struct {
+	mu         sync.Mutex // serializes mutations: apply_ops, trash purges
 	store      *sqlite.Store
+	cache      *sqlite.CacheStore
 	logger     *logging.Logger
 	repo       *gitvcs.Repo
 	profileDir string
@@ -73,9 +76,18 @@ func run(ctx context.Context, profileDir string, cfg *config.ProfileConfig, sock
 		return fmt.Errorf("open sqlite: %w", err)
 	}
 	defer store.Close()
+	store.SetURLRules(cfg.URLs.Rules())
 	if err := store.Init(ctx); err != nil {
 		return fmt.Errorf("init sqlite: %w", err)
 	}
+	cache, err := sqlite.OpenCache(config.ResolvePath(profileDir, cfg.Storage.CacheDBPath))
+	if err != nil {
+		return fmt.Errorf("open cache: %w", err)
+	}
+	defer cache.Close()
+	if err := cache.Init(ctx); err != nil {
+		return fmt.Errorf("init cache: %w", err)
+	}
 
 	socketPath := socketOverride
 	if socketPath == "" {
@@ -92,8 +104,9 @@ func run(ctx context.Context, profileDir string, cfg *config.ProfileConfig, sock
 	}
 
 	eh := newEventHub(logger)
-	d := &daemon{store: store, logger: logger, repo: vcRepo, profileDir: profileDir, cfg: cfg, eventHub: eh}
+	d := &daemon{store: store, cache: cache, logger: logger, repo: vcRepo, profileDir: profileDir, cfg: cfg, eventHub: eh}
 	d.registerHandlers(srv)
+	go d.runTrashPurge(ctx)
 
 	if err := srv.Start(ctx, socketPath); err != nil {
 		return fmt.Errorf("start ipc: %w", err)
@@ -134,6 +147,25 @@ func pingHandler(logger *logging.Logger) ipc.HandlerFunc {
 	}
 }
 
+// commitTree exports the snapshot, commits it to git, and notifies
+// subscribers. Callers must hold d.mu.
+func (d *daemon) commitTree(ctx context.Context, tree core.Tree, message string) (core.Tree, vcsStatus) {
+	status := vcsStatus{Pending: true}
+	if err := writeSnapshot(d.profileDir, tree); err != nil {
+		d.logger.Printf("snapshot write failed: %v", err)
+	} else if d.repo != nil {
+		files := []string{d.store.Path(), filepath.Join(d.profileDir, "snapshot.json")}
+		gstatus, err := d.repo.Commit(ctx, message, files)
+		if err != nil {
+			d.logger.Printf("commit failed: %v", err)
+		} else {
+			status = fromGitStatus(gstatus)
+		}
+	}
+	d.broadcastTreeChanged(tree)
+	return tree, status
+}
+
 func (d *daemon) broadcastTreeChanged(tree core.Tree) {
 	if d.eventHub == nil {
 		return
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleGetOpLog(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		// After is the cursor: the seq of the last entry already seen.
+		After int64 `json:"after"`
+		Limit int   `json:"limit"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, ipc.Errorf("INVALID_REQUEST", "invalid get_op_log params", nil)
+		}
+	}
+	if req.Limit <= 0 || req.Limit > 500 {
+		req.Limit = 100
+	}
+	entries, err := d.store.OpLog(ctx, req.After, req.Limit)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	results := make([]map[string]any, 0, len(entries))
+	for _, entry := range entries {
+		ops, err := core.MarshalOps(entry.Ops)
+		if err != nil {
+			return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+		}
+		results = append(results, map[string]any{
+			"seq":        entry.Seq,
+			"batchId":    entry.BatchID,
+			"appliedAt":  entry.AppliedAt,
+			"client":     entry.Client,
+			"origin":     entry.Origin,
+			"ops":        json.RawMessage(ops),
+			"createdIds": entry.CreatedIDs,
+		})
+	}
+	resp := map[string]any{"entries": results}
+	if len(entries) == req.Limit {
+		resp["nextCursor"] = entries[len(entries)-1].Seq
+	}
+	return resp, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleResolvePath(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || req.Path == "" {
+		return nil, ipc.Errorf("INVALID_REQUEST", "path required", nil)
+	}
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	id, err := core.ResolvePath(tree, req.Path)
+	if err != nil {
+		return nil, pathError(err)
+	}
+	node := nodeSummary(tree.Nodes[id])
+	node["breadcrumbs"] = core.Breadcrumbs(tree, id)
+	return map[string]any{"nodeId": id, "path": core.NodePath(tree, id), "node": node}, nil
+}
+
+// resolvePaths replaces every node reference in ops that is a title path
+// with the ID it names in tree. Nodes created earlier in the same batch are
+// not in tree, so ops must reference them by temp ID.
+func resolvePaths(tree core.Tree, ops []core.Op) ([]core.Op, *ipc.Error) {
+	var firstErr error
+	resolve := func(ref string) string {
+		if !core.IsPath(ref) {
+			return ref
+		}
+		id, err := core.ResolvePath(tree, ref)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return id
+	}
+	out := make([]core.Op, len(ops))
+	for i, op := range ops {
+		out[i] = core.ResolveOpIDs(op, resolve)
+		if firstErr != nil {
+			rpcErr := pathError(firstErr)
+			rpcErr.Details["index"] = i
+			return nil, rpcErr
+		}
+	}
+	return out, nil
+}
+
+// pathError maps a path resolution failure to a protocol error.
+func pathError(err error) *ipc.Error {
+	details := map[string]any{}
+	var perr *core.PathError
+	if errors.As(err, &perr) {
+		details["path"] = perr.Path
+		if perr.Segment != "" {
+			details["segment"] = perr.Segment
+		}
+		if len(perr.Matches) > 0 {
+			details["nodeIds"] = perr.Matches
+		}
+	}
+	switch {
+	case errors.Is(err, core.ErrAmbiguousPath):
+		return ipc.Errorf("AMBIGUOUS_PATH", err.Error(), details)
+	case errors.Is(err, core.ErrPathNotFound):
+		return ipc.Errorf("NOT_FOUND", err.Error(), details)
+	default:
+		return ipc.Errorf("INVALID_REQUEST", err.Error(), details)
+	}
+}
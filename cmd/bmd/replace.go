@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+// dryRunReplace returns the replace op of a dry-run batch. A dry run previews
+// against the current tree, so it must be the only op in its batch.
+func dryRunReplace(ops []core.Op) (core.ReplaceOp, bool, *ipc.Error) {
+	for _, op := range ops {
+		replace, ok := op.(core.ReplaceOp)
+		if !ok || !replace.DryRun {
+			continue
+		}
+		if len(ops) > 1 {
+			return core.ReplaceOp{}, false, ipc.Errorf("INVALID_REQUEST", "a dry-run replace must be the only op in its batch", nil)
+		}
+		return replace, true, nil
+	}
+	return core.ReplaceOp{}, false, nil
+}
+
+// previewReplace lists the rewrites of a dry-run replace without applying
+// them. Clients pass the returned version as expectedVersion when applying
+// the same replace for real.
+func previewReplace(tree core.Tree, op core.ReplaceOp) (any, *ipc.Error) {
+	plan, err := core.PlanReplace(tree, op)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	if plan == nil {
+		plan = []core.Replacement{}
+	}
+	return map[string]any{"dryRun": true, "replacements": plan, "version": tree.Version}, nil
+}
@@ -5,23 +5,37 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/rexliu/s0f/pkg/core"
 	"github.com/rexliu/s0f/pkg/ipc"
+	"github.com/rexliu/s0f/pkg/storage/sqlite"
 	gitvcs "github.com/rexliu/s0f/pkg/vcs/git"
 )
 
 func (d *daemon) registerHandlers(srv *ipc.Server) {
 	srv.Register("ping", pingHandler(d.logger))
 	srv.Register("get_tree", d.handleGetTree)
+	srv.Register("get_subtree", d.handleGetSubtree)
+	srv.Register("get_children", d.handleGetChildren)
 	srv.Register("apply_ops", d.handleApplyOps)
 	srv.Register("vcs_push", d.handleVCSPush)
 	srv.Register("vcs_pull", d.handleVCSPull)
 	srv.Register("vcs_status", d.handleVCSStatus)
 	srv.Register("search", d.handleSearch)
 	srv.Register("get_snapshot", d.handleGetSnapshot)
+	srv.Register("empty_trash", d.handleEmptyTrash)
+	srv.Register("undo", d.handleUndo)
+	srv.Register("redo", d.handleRedo)
+	srv.Register("get_op_log", d.handleGetOpLog)
+	srv.Register("resolve_smart_folder", d.handleResolveSmartFolder)
+	srv.Register("find_duplicates", d.handleFindDuplicates)
+	srv.Register("resolve_path", d.handleResolvePath)
+	srv.Register("put_favicon", d.handlePutFavicon)
+	srv.Register("get_favicons", d.handleGetFavicons)
+	srv.Register("record_visit", d.handleRecordVisit)
 }
 
 func (d *daemon) handleGetTree(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
@@ -29,10 +43,12 @@ func (d *daemon) handleGetTree(ctx context.Context, params json.RawMessage) (any
 	if err != nil {
 		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
 	}
-	return map[string]any{"tree": tree}, nil
+	return map[string]any{"tree": tree, "smartFolders": resolveSmartFolders(tree, time.Now())}, nil
 }
 
 func (d *daemon) handleApplyOps(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	var payload applyOpsParams
 	if err := json.Unmarshal(params, &payload); err != nil {
 		return nil, ipc.Errorf("INVALID_REQUEST", "invalid params", nil)
@@ -44,38 +60,40 @@ func (d *daemon) handleApplyOps(ctx context.Context, params json.RawMessage) (an
 	if err != nil {
 		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
 	}
+	if rpcErr := checkVersion(payload.ExpectedVersion, tree); rpcErr != nil {
+		return nil, rpcErr
+	}
 	ops, err := payload.toCoreOps()
 	if err != nil {
 		return nil, ipc.Errorf("INVALID_REQUEST", err.Error(), nil)
 	}
-	if err := core.ValidateOps(tree, ops); err != nil {
-		return nil, ipc.Errorf("VALIDATION_FAILED", err.Error(), nil)
+	ops, rpcErr := resolvePaths(tree, ops)
+	if rpcErr != nil {
+		return nil, rpcErr
 	}
-	updated, err := d.store.ApplyOps(ctx, ops)
-	if err != nil {
-		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	ops = core.NormalizeOps(ops)
+	dryRun, isDryRun, rpcErr := dryRunReplace(ops)
+	if rpcErr != nil {
+		return nil, rpcErr
 	}
-	status := vcsStatus{Pending: true}
-	if err := writeSnapshot(d.profileDir, updated); err != nil {
-		d.logger.Printf("snapshot write failed: %v", err)
-	} else if d.repo != nil {
-		files := []string{d.store.Path(), filepath.Join(d.profileDir, "snapshot.json")}
-		message := fmt.Sprintf("apply %d ops: %s", len(ops), payload.firstOpType())
-		gstatus, err := d.repo.Commit(ctx, message, files)
-		if err != nil {
-			d.logger.Printf("commit failed: %v", err)
-		} else {
-			status = fromGitStatus(gstatus)
-			if gstatus.Hash != "" {
-				updated.Version = gstatus.Hash
-			}
-		}
+	if err := core.ValidateOps(tree, ops, d.cfg.ValidationPolicy()); err != nil {
+		return nil, validationError(err)
 	}
+	if isDryRun {
+		return previewReplace(tree, dryRun)
+	}
+	result, err := d.store.ApplyOps(ctx, ops, sqlite.ApplyOptions{Client: payload.Client})
+	if err != nil {
+		return nil, storageError(err)
+	}
+	message := fmt.Sprintf("apply %d ops: %s", len(ops), payload.firstOpType())
+	updated, status := d.commitTree(ctx, result.Tree, message)
 	resp := map[string]any{
 		"tree":      updated,
 		"vcsStatus": status,
+		"batchId":   result.BatchID,
+		"tempIds":   result.TempIDs,
 	}
-	d.broadcastTreeChanged(updated)
 	return resp, nil
 }
 
@@ -159,6 +177,87 @@ func (d *daemon) handleGetSnapshot(ctx context.Context, params json.RawMessage)
 	return payload, nil
 }
 
+// checkVersion rejects a write made against a stale copy of the tree.
+// Callers hold d.mu so the version cannot move before the write commits.
+func checkVersion(expected *string, tree core.Tree) *ipc.Error {
+	if expected == nil || *expected == tree.Version {
+		return nil
+	}
+	return ipc.Errorf("VERSION_CONFLICT", "tree changed since expected version", map[string]any{
+		"expectedVersion": *expected,
+		"currentVersion":  tree.Version,
+	})
+}
+
+// validationCodes maps validation sentinels to the IPC error codes clients
+// branch on; other validation failures report VALIDATION_FAILED.
+var validationCodes = []struct {
+	err  error
+	code string
+}{
+	{core.ErrInvalidNode, "NOT_FOUND"},
+	{core.ErrInvalidParent, "INVALID_PARENT"},
+	{core.ErrCycleDetected, "CYCLE_DETECTED"},
+	{core.ErrRootImmutable, "ROOT_IMMUTABLE"},
+	{core.ErrInvalidIndex, "OUT_OF_RANGE"},
+	{core.ErrFolderNotEmpty, "FOLDER_NOT_EMPTY"},
+	{core.ErrSchemeNotAllowed, "SCHEME_NOT_ALLOWED"},
+}
+
+func validationCode(err error) (string, bool) {
+	for _, c := range validationCodes {
+		if errors.Is(err, c.err) {
+			return c.code, true
+		}
+	}
+	return "", false
+}
+
+// validationError maps a core.ValidateOps failure to a protocol error.
+func validationError(err error) *ipc.Error {
+	code, ok := validationCode(err)
+	if !ok {
+		code = "VALIDATION_FAILED"
+	}
+	var details map[string]any
+	var verr *core.ValidationError
+	if errors.As(err, &verr) {
+		details = map[string]any{
+			"index":  verr.Index,
+			"opType": verr.OpType,
+			"reason": verr.Err.Error(),
+		}
+		if verr.NodeID != "" {
+			details["nodeId"] = verr.NodeID
+		}
+		if verr.ParentID != "" {
+			details["parentId"] = verr.ParentID
+		}
+		var serr *core.SchemeError
+		if errors.As(err, &serr) {
+			details["scheme"] = serr.Scheme
+			details["allowedSchemes"] = serr.Allowed
+		}
+		var ferr *core.FieldError
+		if errors.As(err, &ferr) {
+			details["field"] = ferr.Field
+			if ferr.Limit > 0 {
+				details["limit"] = ferr.Limit
+			}
+		}
+	}
+	return ipc.Errorf(code, err.Error(), details)
+}
+
+// storageError maps a store failure to a protocol error, surfacing core
+// sentinels the store re-checks inside its transaction.
+func storageError(err error) *ipc.Error {
+	if _, ok := validationCode(err); ok {
+		return validationError(err)
+	}
+	return ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+}
+
 type vcsStatus struct {
 	Committed bool   `json:"committed"`
 	Pending   bool   `json:"pending"`
@@ -174,7 +273,11 @@ func fromGitStatus(status gitvcs.Status) vcsStatus {
 }
 
 type applyOpsParams struct {
-	Ops []rpcOp `json:"ops"`
+	Ops    []rpcOp `json:"ops"`
+	Client string  `json:"client,omitempty"`
+	// ExpectedVersion, when set, must match the current tree version or the
+	// batch is rejected with VERSION_CONFLICT.
+	ExpectedVersion *string `json:"expectedVersion,omitempty"`
 }
 
 func (p applyOpsParams) toCoreOps() ([]core.Op, error) {
@@ -190,16 +293,35 @@ func (p applyOpsParams) toCoreOps() ([]core.Op, error) {
 }
 
 type rpcOp struct {
-	Type        string     `json:"type"`
-	ParentID    string     `json:"parentId"`
-	Title       string     `json:"title"`
-	URL         string     `json:"url"`
-	Index       *int       `json:"index"`
-	NodeID      string     `json:"nodeId"`
-	NewParentID string     `json:"newParentId"`
-	NewIndex    *int       `json:"newIndex"`
-	Recursive   bool       `json:"recursive"`
-	Tabs        []core.Tab `json:"tabs"`
+	Type        string           `json:"type"`
+	TempID      string           `json:"tempId"`
+	ParentID    string           `json:"parentId"`
+	Title       string           `json:"title"`
+	URL         string           `json:"url"`
+	Notes       *string          `json:"notes"`
+	Index       *int             `json:"index"`
+	NodeID      string           `json:"nodeId"`
+	NewParentID string           `json:"newParentId"`
+	NewIndex    *int             `json:"newIndex"`
+	Recursive   bool             `json:"recursive"`
+	Soft        bool             `json:"soft"`
+	Tabs        []core.Tab       `json:"tabs"`
+	Tags        []string         `json:"tags"`
+	Query       *core.SmartQuery `json:"query"`
+	NodeIDs     []string         `json:"nodeIds"`
+	Strategy    string           `json:"strategy"`
+	By          string           `json:"by"`
+	Descending  bool             `json:"descending"`
+	KindFirst   bool             `json:"kindFirst"`
+	Find        string           `json:"find"`
+	Replace     string           `json:"replace"`
+	Regex       bool             `json:"regex"`
+	Fields      []string         `json:"fields"`
+	DryRun      bool             `json:"dryRun"`
+	SourceID    string           `json:"sourceId"`
+	TargetID    string           `json:"targetId"`
+	Interleave  bool             `json:"interleave"`
+	Dedupe      bool             `json:"dedupe"`
 }
 
 func (op rpcOp) toCoreOp() (core.Op, error) {
@@ -208,12 +330,25 @@ func (op rpcOp) toCoreOp() (core.Op, error) {
 		if op.ParentID == "" {
 			return nil, fmt.Errorf("parentId required for add_folder")
 		}
-		return core.AddFolderOp{ParentID: op.ParentID, Title: op.Title, Index: op.Index}, nil
+		return core.AddFolderOp{ParentID: op.ParentID, Title: op.Title, Index: op.Index, TempID: op.TempID}, nil
 	case "add_bookmark":
 		if op.ParentID == "" || op.URL == "" {
 			return nil, fmt.Errorf("parentId and url required for add_bookmark")
 		}
-		return core.AddBookmarkOp{ParentID: op.ParentID, Title: op.Title, URL: op.URL, Index: op.Index}, nil
+		return core.AddBookmarkOp{ParentID: op.ParentID, Title: op.Title, URL: op.URL, Index: op.Index, TempID: op.TempID}, nil
+	case "add_separator":
+		if op.ParentID == "" {
+			return nil, fmt.Errorf("parentId required for add_separator")
+		}
+		if op.Title != "" || op.URL != "" {
+			return nil, fmt.Errorf("add_separator takes no title or url")
+		}
+		return core.AddSeparatorOp{ParentID: op.ParentID, Index: op.Index, TempID: op.TempID}, nil
+	case "add_smart_folder":
+		if op.ParentID == "" || op.Query == nil {
+			return nil, fmt.Errorf("parentId and query required for add_smart_folder")
+		}
+		return core.AddSmartFolderOp{ParentID: op.ParentID, Title: op.Title, Query: *op.Query, Index: op.Index, TempID: op.TempID}, nil
 	case "rename_node":
 		if op.NodeID == "" {
 			return nil, fmt.Errorf("nodeId required for rename_node")
@@ -228,17 +363,66 @@ func (op rpcOp) toCoreOp() (core.Op, error) {
 		if op.NodeID == "" {
 			return nil, fmt.Errorf("nodeId required for delete_node")
 		}
-		return core.DeleteNodeOp{NodeID: op.NodeID, Recursive: op.Recursive}, nil
+		return core.DeleteNodeOp{NodeID: op.NodeID, Recursive: op.Recursive, Soft: op.Soft}, nil
+	case "restore_node":
+		if op.NodeID == "" {
+			return nil, fmt.Errorf("nodeId required for restore_node")
+		}
+		return core.RestoreNodeOp{NodeID: op.NodeID, ParentID: op.ParentID, Index: op.Index}, nil
 	case "update_bookmark":
 		if op.NodeID == "" {
 			return nil, fmt.Errorf("nodeId required for update_bookmark")
 		}
-		return core.UpdateBookmarkOp{NodeID: op.NodeID, Title: optStr(op.Title), URL: optStr(op.URL)}, nil
+		return core.UpdateBookmarkOp{NodeID: op.NodeID, Title: optStr(op.Title), URL: optStr(op.URL), Notes: op.Notes}, nil
+	case "update_folder":
+		if op.NodeID == "" {
+			return nil, fmt.Errorf("nodeId required for update_folder")
+		}
+		return core.UpdateFolderOp{NodeID: op.NodeID, Title: optStr(op.Title), Notes: op.Notes, Query: op.Query}, nil
+	case "add_tags":
+		if op.NodeID == "" || len(op.Tags) == 0 {
+			return nil, fmt.Errorf("nodeId and tags required for add_tags")
+		}
+		return core.AddTagsOp{NodeID: op.NodeID, Tags: op.Tags}, nil
+	case "remove_tags":
+		if op.NodeID == "" || len(op.Tags) == 0 {
+			return nil, fmt.Errorf("nodeId and tags required for remove_tags")
+		}
+		return core.RemoveTagsOp{NodeID: op.NodeID, Tags: op.Tags}, nil
 	case "save_session":
 		if op.ParentID == "" {
 			return nil, fmt.Errorf("parentId required for save_session")
 		}
-		return core.SaveSessionOp{ParentID: op.ParentID, Title: op.Title, Tabs: op.Tabs, Index: op.Index}, nil
+		return core.SaveSessionOp{ParentID: op.ParentID, Title: op.Title, Tabs: op.Tabs, Index: op.Index, TempID: op.TempID}, nil
+	case "sort_children":
+		if op.NodeID == "" || op.By == "" {
+			return nil, fmt.Errorf("nodeId and by required for sort_children")
+		}
+		return core.SortChildrenOp{NodeID: op.NodeID, By: core.SortKey(op.By), Descending: op.Descending, KindFirst: op.KindFirst, Recursive: op.Recursive}, nil
+	case "copy_node":
+		if op.NodeID == "" || op.NewParentID == "" {
+			return nil, fmt.Errorf("nodeId and newParentId required for copy_node")
+		}
+		return core.CopyNodeOp{NodeID: op.NodeID, NewParentID: op.NewParentID, NewIndex: op.NewIndex, TempID: op.TempID}, nil
+	case "replace":
+		if op.NodeID == "" || op.Find == "" {
+			return nil, fmt.Errorf("nodeId and find required for replace")
+		}
+		fields := make([]core.ReplaceField, 0, len(op.Fields))
+		for _, f := range op.Fields {
+			fields = append(fields, core.ReplaceField(f))
+		}
+		return core.ReplaceOp{NodeID: op.NodeID, Find: op.Find, Replace: op.Replace, Regex: op.Regex, Fields: fields, DryRun: op.DryRun}, nil
+	case "merge_folders":
+		if op.SourceID == "" || op.TargetID == "" {
+			return nil, fmt.Errorf("sourceId and targetId required for merge_folders")
+		}
+		return core.MergeFoldersOp{SourceID: op.SourceID, TargetID: op.TargetID, Interleave: op.Interleave, Dedupe: op.Dedupe, Soft: op.Soft}, nil
+	case "merge_duplicates":
+		if len(op.NodeIDs) < 2 {
+			return nil, fmt.Errorf("at least two nodeIds required for merge_duplicates")
+		}
+		return core.MergeDuplicatesOp{NodeIDs: op.NodeIDs, Strategy: core.MergeStrategy(op.Strategy), Soft: op.Soft}, nil
 	default:
 		return nil, fmt.Errorf("unknown op type %s", op.Type)
 	}
@@ -260,8 +444,9 @@ func (p applyOpsParams) firstOpType() string {
 }
 func (d *daemon) handleSearch(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
 	var req struct {
-		Query string `json:"query"`
-		Limit int    `json:"limit"`
+		Query string   `json:"query"`
+		Tags  []string `json:"tags"`
+		Limit int      `json:"limit"`
 	}
 	if err := json.Unmarshal(params, &req); err != nil {
 		return nil, ipc.Errorf("INVALID_REQUEST", "invalid search params", nil)
@@ -273,24 +458,81 @@ func (d *daemon) handleSearch(ctx context.Context, params json.RawMessage) (any,
 	if err != nil {
 		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
 	}
-	query := strings.ToLower(req.Query)
-	results := make([]map[string]any, 0)
+	query := core.SmartQuery{Text: req.Query, Tags: core.NormalizeTags(req.Tags)}
+	// A URL query matches bookmarks through their canonical form, so case,
+	// default ports, and tracking params in either side do not matter.
+	if canonical, err := core.NormalizeURL(req.Query, d.cfg.URLs.Rules()); err == nil {
+		query.Text = canonical
+	}
+	now := time.Now()
+	var matches []core.Node
 	for _, node := range tree.Nodes {
-		if len(results) >= req.Limit {
-			break
+		if node.Kind == core.KindSeparator || core.IsTrashed(tree, node.ID) {
+			continue
+		}
+		if query.Matches(node, now) {
+			matches = append(matches, node)
 		}
-		if query == "" || strings.Contains(strings.ToLower(node.Title), query) || (node.URL != nil && strings.Contains(strings.ToLower(*node.URL), query)) {
-			results = append(results, map[string]any{
-				"id":    node.ID,
-				"title": node.Title,
-				"url":   node.URL,
-				"kind":  node.Kind,
-			})
+	}
+	ids := make([]string, len(matches))
+	for i, node := range matches {
+		ids[i] = node.ID
+	}
+	visits, err := d.cache.Visits(ctx, ids)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	rankByFrecency(matches, visits, now)
+	if len(matches) > req.Limit {
+		matches = matches[:req.Limit]
+	}
+	results := make([]map[string]any, 0, len(matches))
+	for _, node := range matches {
+		summary := nodeSummary(node)
+		summary["breadcrumbs"] = core.Breadcrumbs(tree, node.ID)
+		if visit, ok := visits[node.ID]; ok {
+			summary["visitCount"] = visit.Count
+			summary["lastVisitAt"] = visit.LastVisitAt
 		}
+		results = append(results, summary)
 	}
 	return map[string]any{"matches": results}, nil
 }
 
+// rankByFrecency orders nodes by descending frecency, falling back to title
+// and then ID so unvisited matches come back in a stable order.
+func rankByFrecency(nodes []core.Node, visits map[string]sqlite.Visit, now time.Time) {
+	score := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		if visit, ok := visits[node.ID]; ok {
+			score[node.ID] = core.Frecency(visit.Count, visit.LastVisitAt, now)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if score[a.ID] != score[b.ID] {
+			return score[a.ID] > score[b.ID]
+		}
+		if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+			return ta < tb
+		}
+		return a.ID < b.ID
+	})
+}
+
+// nodeSummary is the node shape returned by search-style RPCs.
+func nodeSummary(node core.Node) map[string]any {
+	return map[string]any{
+		"id":           node.ID,
+		"title":        node.Title,
+		"url":          node.URL,
+		"canonicalUrl": node.CanonicalURL,
+		"kind":         node.Kind,
+		"tags":         node.Tags,
+		"notes":        node.Notes,
+	}
+}
+
 func (d *daemon) handleSubscribeEvents(ctx context.Context) (<-chan []byte, *ipc.Error) {
 	if d.eventHub == nil {
 		return nil, ipc.Errorf("INTERNAL", "event hub unavailable", nil)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleResolveSmartFolder(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		NodeID string `json:"nodeId"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || req.NodeID == "" {
+		return nil, ipc.Errorf("INVALID_REQUEST", "nodeId required", nil)
+	}
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	node, ok := tree.Nodes[req.NodeID]
+	if !ok {
+		return nil, ipc.Errorf("NOT_FOUND", "node not found", map[string]any{"nodeId": req.NodeID})
+	}
+	ids, err := core.ResolveSmartFolder(tree, node.ID, time.Now())
+	if err != nil {
+		return nil, ipc.Errorf("INVALID_REQUEST", "node is not a smart folder", map[string]any{"nodeId": req.NodeID})
+	}
+	matches := make([]map[string]any, 0, len(ids))
+	for _, id := range ids {
+		matches = append(matches, nodeSummary(tree.Nodes[id]))
+	}
+	return map[string]any{"nodeId": node.ID, "query": node.Query, "matches": matches}, nil
+}
+
+// resolveSmartFolders evaluates every smart folder outside the trash, keyed by
+// folder ID.
+func resolveSmartFolders(tree core.Tree, now time.Time) map[string][]string {
+	out := make(map[string][]string)
+	for id, node := range tree.Nodes {
+		if node.Kind != core.KindSmart || core.IsTrashed(tree, id) {
+			continue
+		}
+		ids, err := core.ResolveSmartFolder(tree, id, now)
+		if err != nil {
+			continue
+		}
+		if ids == nil {
+			ids = []string{}
+		}
+		out[id] = ids
+	}
+	return out
+}
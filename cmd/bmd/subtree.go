@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+	"github.com/rexliu/s0f/pkg/storage/sqlite"
+)
+
+func (d *daemon) handleGetSubtree(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		NodeID string `json:"nodeId"`
+		// Depth limits how many levels below the node are loaded; omitted
+		// loads the whole subtree and 0 only the node itself.
+		Depth *int `json:"depth"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || req.NodeID == "" {
+		return nil, ipc.Errorf("INVALID_REQUEST", "nodeId required", nil)
+	}
+	depth := -1
+	if req.Depth != nil {
+		if *req.Depth < 0 {
+			return nil, ipc.Errorf("INVALID_REQUEST", "depth must not be negative", map[string]any{"depth": *req.Depth})
+		}
+		depth = *req.Depth
+	}
+	sub, err := d.store.LoadSubtree(ctx, req.NodeID, depth)
+	if errors.Is(err, core.ErrInvalidNode) {
+		return nil, ipc.Errorf("NOT_FOUND", "node not found", map[string]any{"nodeId": req.NodeID})
+	}
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	return map[string]any{"tree": sub.Tree, "childCounts": sub.ChildCounts}, nil
+}
+
+func (d *daemon) handleGetChildren(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		ParentID string `json:"parentId"`
+		// Cursor is the nextCursor of the previous page.
+		Cursor string `json:"cursor"`
+		Limit  int    `json:"limit"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || req.ParentID == "" {
+		return nil, ipc.Errorf("INVALID_REQUEST", "parentId required", nil)
+	}
+	if req.Limit <= 0 || req.Limit > 500 {
+		req.Limit = 100
+	}
+	page, err := d.store.LoadChildren(ctx, req.ParentID, req.Cursor, req.Limit)
+	switch {
+	case errors.Is(err, core.ErrInvalidNode):
+		return nil, ipc.Errorf("NOT_FOUND", "node not found", map[string]any{"nodeId": req.ParentID})
+	case errors.Is(err, sqlite.ErrInvalidCursor):
+		return nil, ipc.Errorf("INVALID_REQUEST", err.Error(), map[string]any{"cursor": req.Cursor})
+	case err != nil:
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	resp := map[string]any{
+		"version":     page.Version,
+		"children":    page.Nodes,
+		"total":       page.Total,
+		"childCounts": page.ChildCounts,
+	}
+	if page.NextCursor != "" {
+		resp["nextCursor"] = page.NextCursor
+	}
+	return resp, nil
+}
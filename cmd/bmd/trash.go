@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleEmptyTrash(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed, err := d.store.EmptyTrash(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	status := vcsStatus{}
+	if removed > 0 {
+		tree, status = d.commitTree(ctx, tree, fmt.Sprintf("empty trash: %d nodes", removed))
+		d.pruneVisits(ctx, tree)
+	}
+	return map[string]any{
+		"removed":   removed,
+		"tree":      tree,
+		"vcsStatus": status,
+	}, nil
+}
+
+// runTrashPurge periodically deletes trashed nodes older than the configured
+// retention until ctx is cancelled.
+func (d *daemon) runTrashPurge(ctx context.Context) {
+	interval := time.Duration(d.cfg.Trash.PurgeIntervalMinutes) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.purgeTrash(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *daemon) purgeTrash(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	retention := time.Duration(d.cfg.Trash.RetentionDays) * 24 * time.Hour
+	removed, err := d.store.PurgeTrash(ctx, time.Now().Add(-retention))
+	if err != nil {
+		d.logger.Printf("trash purge failed: %v", err)
+		return
+	}
+	tree, err := d.store.LoadTree(ctx)
+	if err != nil {
+		d.logger.Printf("trash purge reload failed: %v", err)
+		return
+	}
+	// Pruning runs on every pass, not only after a purge, so it also
+	// catches bookmarks deleted outright by apply_ops.
+	defer d.pruneVisits(ctx, tree)
+	if removed == 0 {
+		return
+	}
+	d.commitTree(ctx, tree, fmt.Sprintf("purge trash: %d nodes", removed))
+	d.logger.Printf("purged %d trashed nodes older than %d days", removed, d.cfg.Trash.RetentionDays)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+	"github.com/rexliu/s0f/pkg/ipc"
+)
+
+func (d *daemon) handleRecordVisit(ctx context.Context, params json.RawMessage) (any, *ipc.Error) {
+	var req struct {
+		// NodeID names the bookmark opened; otherwise URL counts a visit for
+		// every bookmark with the same canonical URL.
+		NodeID    string `json:"nodeId"`
+		URL       string `json:"url"`
+		VisitedAt int64  `json:"visitedAt"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || (req.NodeID == "") == (req.URL == "") {
+		return nil, ipc.Errorf("INVALID_REQUEST", "exactly one of nodeId or url required", nil)
+	}
+	if req.VisitedAt == 0 {
+		req.VisitedAt = time.Now().UnixMilli()
+	}
+	var ids []string
+	if req.NodeID != "" {
+		sub, err := d.store.LoadSubtree(ctx, req.NodeID, 0)
+		if errors.Is(err, core.ErrInvalidNode) {
+			return nil, ipc.Errorf("NOT_FOUND", "node not found", map[string]any{"nodeId": req.NodeID})
+		}
+		if err != nil {
+			return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+		}
+		if sub.Tree.Nodes[req.NodeID].Kind != core.KindBookmark {
+			return nil, ipc.Errorf("INVALID_REQUEST", "node is not a bookmark", map[string]any{"nodeId": req.NodeID})
+		}
+		ids = []string{req.NodeID}
+	} else {
+		// The bridge reports every visit, so pages that are not bookmarked,
+		// including ones like about:blank that no bookmark could hold, are
+		// not an error; they are just not counted.
+		var err error
+		ids, err = d.store.BookmarksByURL(ctx, req.URL)
+		if err != nil && !errors.Is(err, core.ErrInvalidURL) {
+			return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+		}
+	}
+	if err := d.cache.RecordVisit(ctx, ids, req.VisitedAt); err != nil {
+		return nil, ipc.Errorf("STORAGE_ERROR", err.Error(), nil)
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return map[string]any{"nodeIds": ids}, nil
+}
+
+// pruneVisits drops the visits of nodes no longer in tree. Callers hold d.mu.
+func (d *daemon) pruneVisits(ctx context.Context, tree core.Tree) {
+	removed, err := d.cache.PruneVisits(ctx, func(id string) bool {
+		_, ok := tree.Nodes[id]
+		return ok
+	})
+	if err != nil {
+		d.logger.Printf("visit prune failed: %v", err)
+		return
+	}
+	if removed > 0 {
+		d.logger.Printf("pruned visits of %d deleted nodes", removed)
+	}
+}
@@ -42,11 +42,26 @@ func main() {
 			fmt.Fprintf(os.Stderr, "apply error: %v\n", err)
 			os.Exit(1)
 		}
+	case "undo", "redo":
+		if err := historyCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
 	case "search":
 		if err := searchCommand(os.Args[2:]); err != nil {
 			fmt.Fprintf(os.Stderr, "search error: %v\n", err)
 			os.Exit(1)
 		}
+	case "dedupe":
+		if err := dedupeCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dedupe error: %v\n", err)
+			os.Exit(1)
+		}
+	case "replace":
+		if err := replaceCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "replace error: %v\n", err)
+			os.Exit(1)
+		}
 	case "watch":
 		if err := watchCommand(os.Args[2:]); err != nil {
 			fmt.Fprintf(os.Stderr, "watch error: %v\n", err)
@@ -84,9 +99,13 @@ func usage() {
 	fmt.Println("Commands:")
 	fmt.Println("  init      Initialize a local profile (writes config.toml)")
 	fmt.Println("  ping      Call the daemon ping endpoint via IPC")
-	fmt.Println("  tree      Fetch the current bookmark tree from the daemon")
+	fmt.Println("  tree      Fetch the current bookmark tree from the daemon (--format json|text)")
 	fmt.Println("  apply     Send apply_ops payload (JSON) to the daemon")
-	fmt.Println("  search    Run substring search over title/url")
+	fmt.Println("  undo      Revert the most recent applied batch")
+	fmt.Println("  redo      Reapply the most recently undone batch")
+	fmt.Println("  search    Run substring search over title/url/notes (optionally filtered by --tags)")
+	fmt.Println("  dedupe    List bookmarks sharing a canonical URL (--merge to keep one per group)")
+	fmt.Println("  replace   Find and replace text in titles/URLs under a folder (--dry-run to preview only)")
 	fmt.Println("  watch     Stream tree_changed events from the daemon")
 	fmt.Println("  snapshot  Fetch snapshot payload via IPC")
 	fmt.Println("  diag      Print profile configuration paths")
@@ -142,18 +161,28 @@ func treeCommand(args []string) error {
 	fs := flag.NewFlagSet("tree", flag.ExitOnError)
 	profile := fs.String("profile", "./_dev_profile", "Profile directory")
 	socket := fs.String("socket", "", "Override socket path")
+	format := fs.String("format", "json", "Output format: json or text")
 	_ = fs.Parse(args)
+	if *format != "json" && *format != "text" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
 
 	resp, err := rpcCall(*profile, *socket, "get_tree", json.RawMessage(`{}`))
 	if err != nil {
 		return err
 	}
 	var payload struct {
-		Tree core.Tree `json:"tree"`
+		Tree         core.Tree           `json:"tree"`
+		SmartFolders map[string][]string `json:"smartFolders"`
 	}
 	if err := json.Unmarshal(resp.Result, &payload); err != nil {
 		return fmt.Errorf("decode tree: %w", err)
 	}
+	if *format == "text" {
+		printTree(os.Stdout, payload.Tree, payload.SmartFolders, payload.Tree.RootID, 0)
+		printTree(os.Stdout, payload.Tree, payload.SmartFolders, core.TrashID, 0)
+		return nil
+	}
 	out, err := json.MarshalIndent(payload.Tree, "", "  ")
 	if err != nil {
 		return err
@@ -162,6 +191,40 @@ func treeCommand(args []string) error {
 	return nil
 }
 
+// printTree writes id and its descendants as an indented outline. Smart
+// folders list the bookmarks their query currently matches.
+func printTree(w io.Writer, tree core.Tree, smart map[string][]string, id string, depth int) {
+	node, ok := tree.Nodes[id]
+	if !ok {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	switch node.Kind {
+	case core.KindSeparator:
+		fmt.Fprintf(w, "%s%s\n", indent, strings.Repeat("-", 20))
+	case core.KindBookmark:
+		printBookmark(w, indent, node)
+	case core.KindSmart:
+		fmt.Fprintf(w, "%s%s/ (smart)\n", indent, node.Title)
+		for _, match := range smart[id] {
+			printBookmark(w, indent+"  ", tree.Nodes[match])
+		}
+	default:
+		fmt.Fprintf(w, "%s%s/\n", indent, node.Title)
+	}
+	for _, child := range tree.Children[id] {
+		printTree(w, tree, smart, child, depth+1)
+	}
+}
+
+func printBookmark(w io.Writer, indent string, node core.Node) {
+	url := ""
+	if node.URL != nil {
+		url = *node.URL
+	}
+	fmt.Fprintf(w, "%s%s <%s>\n", indent, node.Title, url)
+}
+
 func applyCommand(args []string) error {
 	fs := flag.NewFlagSet("apply", flag.ExitOnError)
 	profile := fs.String("profile", "./_dev_profile", "Profile directory")
@@ -187,14 +250,20 @@ func applyCommand(args []string) error {
 	if len(payload) == 0 {
 		return fmt.Errorf("empty apply_ops payload")
 	}
+	payload, err = withClient(payload)
+	if err != nil {
+		return err
+	}
 
 	resp, err := rpcCall(*profile, *socket, "apply_ops", json.RawMessage(payload))
 	if err != nil {
 		return err
 	}
 	var data struct {
-		Tree      core.Tree      `json:"tree"`
-		VCSStatus map[string]any `json:"vcsStatus"`
+		Tree      core.Tree         `json:"tree"`
+		VCSStatus map[string]any    `json:"vcsStatus"`
+		BatchID   string            `json:"batchId"`
+		TempIDs   map[string]string `json:"tempIds,omitempty"`
 	}
 	if err := json.Unmarshal(resp.Result, &data); err != nil {
 		return fmt.Errorf("decode response: %w", err)
@@ -207,11 +276,45 @@ func applyCommand(args []string) error {
 	return nil
 }
 
+// withClient tags an apply_ops payload with the CLI's client identity for the
+// op log unless the payload names a client already.
+func withClient(payload []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("invalid apply_ops payload: %w", err)
+	}
+	if _, ok := fields["client"]; ok {
+		return payload, nil
+	}
+	fields["client"] = json.RawMessage(`"s0f"`)
+	return json.Marshal(fields)
+}
+
+// historyCommand calls the undo or redo RPC, named by method.
+func historyCommand(method string, args []string) error {
+	fs := flag.NewFlagSet(method, flag.ExitOnError)
+	profile := fs.String("profile", "./_dev_profile", "Profile directory")
+	socket := fs.String("socket", "", "Override socket path")
+	_ = fs.Parse(args)
+
+	resp, err := rpcCall(*profile, *socket, method, json.RawMessage(`{"client":"s0f"}`))
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(resp.Result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 func searchCommand(args []string) error {
 	fs := flag.NewFlagSet("search", flag.ExitOnError)
 	profile := fs.String("profile", "./_dev_profile", "Profile directory")
 	socket := fs.String("socket", "", "Override socket path")
 	query := fs.String("query", "", "Search query (substring)")
+	tags := fs.String("tags", "", "Comma-separated tags that every match must carry")
 	limit := fs.Int("limit", 50, "Maximum results (1-500)")
 	_ = fs.Parse(args)
 
@@ -219,6 +322,9 @@ func searchCommand(args []string) error {
 		"query": *query,
 		"limit": *limit,
 	}
+	if *tags != "" {
+		payload["tags"] = strings.Split(*tags, ",")
+	}
 	raw, err := json.Marshal(payload)
 	if err != nil {
 		return err
@@ -235,6 +341,144 @@ func searchCommand(args []string) error {
 	return nil
 }
 
+func dedupeCommand(args []string) error {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	profile := fs.String("profile", "./_dev_profile", "Profile directory")
+	socket := fs.String("socket", "", "Override socket path")
+	merge := fs.Bool("merge", false, "Merge every group, keeping one bookmark each")
+	strategy := fs.String("strategy", string(core.MergeOldest), "Survivor to keep: oldest, newest, or deepest")
+	soft := fs.Bool("soft", false, "Move merged duplicates to the trash instead of deleting them")
+	_ = fs.Parse(args)
+
+	resp, err := rpcCall(*profile, *socket, "find_duplicates", json.RawMessage(`{}`))
+	if err != nil {
+		return err
+	}
+	var data struct {
+		Version string `json:"version"`
+		Groups  []struct {
+			CanonicalURL string `json:"canonicalUrl"`
+			Nodes        []struct {
+				ID     string `json:"id"`
+				Title  string `json:"title"`
+				Folder string `json:"folder"`
+			} `json:"nodes"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(resp.Result, &data); err != nil {
+		return fmt.Errorf("decode duplicates: %w", err)
+	}
+	if len(data.Groups) == 0 {
+		fmt.Println("no duplicates found")
+		return nil
+	}
+	ops := make([]map[string]any, 0, len(data.Groups))
+	removed := 0
+	for _, group := range data.Groups {
+		fmt.Printf("%s (%d)\n", group.CanonicalURL, len(group.Nodes))
+		ids := make([]string, 0, len(group.Nodes))
+		for _, node := range group.Nodes {
+			fmt.Printf("  %s  %s  [%s]\n", node.Title, node.Folder, node.ID)
+			ids = append(ids, node.ID)
+		}
+		removed += len(ids) - 1
+		ops = append(ops, map[string]any{"type": "merge_duplicates", "nodeIds": ids, "strategy": *strategy, "soft": *soft})
+	}
+	if !*merge {
+		return nil
+	}
+	// Pin the version the groups were read at so a concurrent edit fails the
+	// merge instead of deleting bookmarks that changed since.
+	payload, err := json.Marshal(map[string]any{"ops": ops, "client": "s0f", "expectedVersion": data.Version})
+	if err != nil {
+		return err
+	}
+	resp, err = rpcCall(*profile, *socket, "apply_ops", payload)
+	if err != nil {
+		return err
+	}
+	var applied struct {
+		BatchID string `json:"batchId"`
+	}
+	if err := json.Unmarshal(resp.Result, &applied); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	fmt.Printf("merged %d groups, removed %d bookmarks (batch %s)\n", len(data.Groups), removed, applied.BatchID)
+	return nil
+}
+
+func replaceCommand(args []string) error {
+	fs := flag.NewFlagSet("replace", flag.ExitOnError)
+	profile := fs.String("profile", "./_dev_profile", "Profile directory")
+	socket := fs.String("socket", "", "Override socket path")
+	find := fs.String("find", "", "Text to find (a regular expression with --regex)")
+	replace := fs.String("replace", "", "Replacement text; with --regex it may use $1 or ${name}")
+	regex := fs.Bool("regex", false, "Treat --find as a regular expression")
+	in := fs.String("in", "root", "Folder whose subtree is searched")
+	fields := fs.String("fields", "title,url", "Comma-separated fields to rewrite: title, url")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without applying them")
+	_ = fs.Parse(args)
+	if *find == "" {
+		return fmt.Errorf("--find is required")
+	}
+
+	op := map[string]any{
+		"type":    "replace",
+		"nodeId":  *in,
+		"find":    *find,
+		"replace": *replace,
+		"regex":   *regex,
+		"fields":  strings.Split(*fields, ","),
+		"dryRun":  true,
+	}
+	payload, err := json.Marshal(map[string]any{"ops": []any{op}, "client": "s0f"})
+	if err != nil {
+		return err
+	}
+	resp, err := rpcCall(*profile, *socket, "apply_ops", payload)
+	if err != nil {
+		return err
+	}
+	var preview struct {
+		Version      string             `json:"version"`
+		Replacements []core.Replacement `json:"replacements"`
+	}
+	if err := json.Unmarshal(resp.Result, &preview); err != nil {
+		return fmt.Errorf("decode preview: %w", err)
+	}
+	if len(preview.Replacements) == 0 {
+		fmt.Println("no matches")
+		return nil
+	}
+	for _, r := range preview.Replacements {
+		fmt.Printf("%s [%s]\n", r.Field, r.NodeID)
+		fmt.Printf("- %s\n+ %s\n", r.Old, r.New)
+	}
+	if *dryRun {
+		fmt.Printf("%d changes (dry run, nothing applied)\n", len(preview.Replacements))
+		return nil
+	}
+	// Apply against the previewed version so the printed diff is exactly what
+	// changes.
+	op["dryRun"] = false
+	payload, err = json.Marshal(map[string]any{"ops": []any{op}, "client": "s0f", "expectedVersion": preview.Version})
+	if err != nil {
+		return err
+	}
+	resp, err = rpcCall(*profile, *socket, "apply_ops", payload)
+	if err != nil {
+		return err
+	}
+	var applied struct {
+		BatchID string `json:"batchId"`
+	}
+	if err := json.Unmarshal(resp.Result, &applied); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	fmt.Printf("applied %d changes (batch %s)\n", len(preview.Replacements), applied.BatchID)
+	return nil
+}
+
 func watchCommand(args []string) error {
 	fs := flag.NewFlagSet("watch", flag.ExitOnError)
 	profile := fs.String("profile", "./_dev_profile", "Profile directory")
@@ -300,6 +544,7 @@ func diagCommand(args []string) error {
 	fmt.Printf("Profile: %s\n", cfg.ProfileName)
 	fmt.Printf("Config: %s\n", filepath.Join(*profile, "config.toml"))
 	fmt.Printf("DB Path: %s\n", config.ResolvePath(*profile, cfg.Storage.DBPath))
+	fmt.Printf("Cache DB Path: %s\n", config.ResolvePath(*profile, cfg.Storage.CacheDBPath))
 	fmt.Printf("Socket: %s\n", config.ResolvePath(*profile, cfg.IPC.SocketPath))
 	if cfg.Logging.FilePath != "" {
 		fmt.Printf("Log File: %s\n", config.ResolvePath(*profile, cfg.Logging.FilePath))
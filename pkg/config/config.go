@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/BurntSushi/toml"
+	"github.com/rexliu/s0f/pkg/core"
 )
 
 // IPCConfig defines socket / named pipe settings.
@@ -21,6 +23,8 @@ type StorageConfig struct {
 	DBPath      string `toml:"dbPath"`
 	JournalMode string `toml:"journalMode"`
 	Synchronous string `toml:"synchronous"`
+	// CacheDBPath holds favicons and visits, which are never committed.
+	CacheDBPath string `toml:"cacheDbPath"`
 }
 
 // VCSRemote config.
@@ -45,6 +49,72 @@ type LoggingConfig struct {
 	FileBackups int    `toml:"fileMaxBackups"`
 }
 
+// TrashConfig defines soft-delete retention and purge cadence. A zero value
+// selects the default: 30 days of retention, purged every 60 minutes.
+type TrashConfig struct {
+	RetentionDays        int `toml:"retentionDays"`
+	PurgeIntervalMinutes int `toml:"purgeIntervalMinutes"`
+}
+
+// URLConfig tunes how bookmark URLs are normalized into canonical URLs for
+// search and duplicate detection. The zero value applies every rule.
+type URLConfig struct {
+	// TrailingSlash is "strip" (default), "keep", or "add".
+	TrailingSlash      string `toml:"trailingSlash"`
+	KeepDefaultPort    bool   `toml:"keepDefaultPort"`
+	KeepTrackingParams bool   `toml:"keepTrackingParams"`
+	// TrackingParams replaces the default list of query parameters to drop;
+	// a trailing "*" matches by prefix.
+	TrackingParams []string `toml:"trackingParams"`
+	// AllowedSchemes lists the URL schemes bookmarks may use, such as
+	// "javascript" for bookmarklets or "file". Defaults to http and https.
+	AllowedSchemes []string `toml:"allowedSchemes"`
+}
+
+// Rules converts the config into normalization rules.
+func (c URLConfig) Rules() core.URLRules {
+	rules := core.DefaultURLRules()
+	rules.StripDefaultPort = !c.KeepDefaultPort
+	rules.StripTrackingParams = !c.KeepTrackingParams
+	if len(c.TrackingParams) > 0 {
+		rules.TrackingParams = c.TrackingParams
+	}
+	if c.TrailingSlash != "" {
+		rules.TrailingSlash = core.TrailingSlash(c.TrailingSlash)
+	}
+	return rules
+}
+
+// LimitsConfig caps the length of text fields, in characters. A zero value
+// selects the default limit, so a profile cannot turn a limit off.
+type LimitsConfig struct {
+	MaxTitleLength int `toml:"maxTitleLength"`
+	MaxURLLength   int `toml:"maxUrlLength"`
+	MaxNotesLength int `toml:"maxNotesLength"`
+	MaxTagLength   int `toml:"maxTagLength"`
+}
+
+// ValidationPolicy returns the rules apply_ops enforces for this profile.
+func (cfg *ProfileConfig) ValidationPolicy() core.ValidationPolicy {
+	policy := core.DefaultValidationPolicy()
+	if len(cfg.URLs.AllowedSchemes) > 0 {
+		policy.AllowedSchemes = cfg.URLs.AllowedSchemes
+	}
+	if cfg.Limits.MaxTitleLength > 0 {
+		policy.MaxTitleLength = cfg.Limits.MaxTitleLength
+	}
+	if cfg.Limits.MaxURLLength > 0 {
+		policy.MaxURLLength = cfg.Limits.MaxURLLength
+	}
+	if cfg.Limits.MaxNotesLength > 0 {
+		policy.MaxNotesLength = cfg.Limits.MaxNotesLength
+	}
+	if cfg.Limits.MaxTagLength > 0 {
+		policy.MaxTagLength = cfg.Limits.MaxTagLength
+	}
+	return policy
+}
+
 // ProfileConfig aggregates service configuration for a profile.
 type ProfileConfig struct {
 	ProfileName string        `toml:"profileName"`
@@ -52,6 +122,9 @@ type ProfileConfig struct {
 	VCS         VCSConfig     `toml:"vcs"`
 	IPC         IPCConfig     `toml:"ipc"`
 	Logging     LoggingConfig `toml:"logging"`
+	Trash       TrashConfig   `toml:"trash"`
+	URLs        URLConfig     `toml:"urls"`
+	Limits      LimitsConfig  `toml:"limits"`
 }
 
 // Load reads config.toml from the provided path.
@@ -100,6 +173,7 @@ func DefaultProfile(name string) *ProfileConfig {
 			DBPath:      "state.db",
 			JournalMode: "DELETE",
 			Synchronous: "FULL",
+			CacheDBPath: "cache.db",
 		},
 		VCS: VCSConfig{
 			Enabled:  false,
@@ -109,6 +183,10 @@ func DefaultProfile(name string) *ProfileConfig {
 		IPC: IPCConfig{
 			SocketPath: "ipc.sock",
 		},
+		Trash: TrashConfig{
+			RetentionDays:        30,
+			PurgeIntervalMinutes: 60,
+		},
 	}
 }
 
@@ -123,6 +201,8 @@ func ResolvePath(base, p string) string {
 	return filepath.Join(base, p)
 }
 
+var schemePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
 func (cfg *ProfileConfig) applyDefaults() {
 	if cfg.Storage.JournalMode == "" {
 		cfg.Storage.JournalMode = "DELETE"
@@ -130,12 +210,39 @@ func (cfg *ProfileConfig) applyDefaults() {
 	if cfg.Storage.Synchronous == "" {
 		cfg.Storage.Synchronous = "FULL"
 	}
+	if cfg.Storage.CacheDBPath == "" {
+		cfg.Storage.CacheDBPath = "cache.db"
+	}
 	if cfg.IPC.SocketPath == "" {
 		cfg.IPC.SocketPath = "ipc.sock"
 	}
 	if cfg.VCS.Branch == "" {
 		cfg.VCS.Branch = "main"
 	}
+	if cfg.Trash.RetentionDays == 0 {
+		cfg.Trash.RetentionDays = 30
+	}
+	if cfg.Trash.PurgeIntervalMinutes == 0 {
+		cfg.Trash.PurgeIntervalMinutes = 60
+	}
+	if cfg.URLs.TrailingSlash == "" {
+		cfg.URLs.TrailingSlash = string(core.TrailingSlashStrip)
+	}
+	if len(cfg.URLs.AllowedSchemes) == 0 {
+		cfg.URLs.AllowedSchemes = core.DefaultValidationPolicy().AllowedSchemes
+	}
+	if cfg.Limits.MaxTitleLength == 0 {
+		cfg.Limits.MaxTitleLength = core.DefaultMaxTitleLength
+	}
+	if cfg.Limits.MaxURLLength == 0 {
+		cfg.Limits.MaxURLLength = core.DefaultMaxURLLength
+	}
+	if cfg.Limits.MaxNotesLength == 0 {
+		cfg.Limits.MaxNotesLength = core.DefaultMaxNotesLength
+	}
+	if cfg.Limits.MaxTagLength == 0 {
+		cfg.Limits.MaxTagLength = core.DefaultMaxTagLength
+	}
 }
 
 func (cfg *ProfileConfig) validate() error {
@@ -148,5 +255,21 @@ func (cfg *ProfileConfig) validate() error {
 	if cfg.IPC.SocketPath == "" {
 		return fmt.Errorf("ipc.socketPath required")
 	}
+	if cfg.Trash.RetentionDays < 0 || cfg.Trash.PurgeIntervalMinutes < 0 {
+		return fmt.Errorf("trash.retentionDays and trash.purgeIntervalMinutes must not be negative")
+	}
+	switch core.TrailingSlash(cfg.URLs.TrailingSlash) {
+	case core.TrailingSlashStrip, core.TrailingSlashKeep, core.TrailingSlashAdd:
+	default:
+		return fmt.Errorf("urls.trailingSlash must be strip, keep, or add")
+	}
+	if cfg.Limits.MaxTitleLength < 0 || cfg.Limits.MaxURLLength < 0 || cfg.Limits.MaxNotesLength < 0 || cfg.Limits.MaxTagLength < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	for _, scheme := range cfg.URLs.AllowedSchemes {
+		if !schemePattern.MatchString(scheme) {
+			return fmt.Errorf("urls.allowedSchemes: invalid scheme %q (use lowercase names without \":\")", scheme)
+		}
+	}
 	return nil
 }
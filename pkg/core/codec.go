@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// opDecoders maps op type names to decoders for their JSON bodies.
+var opDecoders = map[string]func(json.RawMessage) (Op, error){
+	"add_folder":       decodeOp[AddFolderOp],
+	"add_bookmark":     decodeOp[AddBookmarkOp],
+	"add_separator":    decodeOp[AddSeparatorOp],
+	"add_smart_folder": decodeOp[AddSmartFolderOp],
+	"rename_node":      decodeOp[RenameNodeOp],
+	"move_node":        decodeOp[MoveNodeOp],
+	"delete_node":      decodeOp[DeleteNodeOp],
+	"restore_node":     decodeOp[RestoreNodeOp],
+	"update_bookmark":  decodeOp[UpdateBookmarkOp],
+	"update_folder":    decodeOp[UpdateFolderOp],
+	"add_tags":         decodeOp[AddTagsOp],
+	"remove_tags":      decodeOp[RemoveTagsOp],
+	"save_session":     decodeOp[SaveSessionOp],
+	"merge_duplicates": decodeOp[MergeDuplicatesOp],
+	"sort_children":    decodeOp[SortChildrenOp],
+	"copy_node":        decodeOp[CopyNodeOp],
+	"replace":          decodeOp[ReplaceOp],
+	"merge_folders":    decodeOp[MergeFoldersOp],
+	"put_nodes":        decodeOp[PutNodesOp],
+}
+
+func decodeOp[T Op](raw json.RawMessage) (Op, error) {
+	var op T
+	err := json.Unmarshal(raw, &op)
+	return op, err
+}
+
+// OpType returns the wire name of op, matching the apply_ops "type" field.
+func OpType(op Op) string {
+	switch op.(type) {
+	case AddFolderOp:
+		return "add_folder"
+	case AddBookmarkOp:
+		return "add_bookmark"
+	case AddSeparatorOp:
+		return "add_separator"
+	case AddSmartFolderOp:
+		return "add_smart_folder"
+	case RenameNodeOp:
+		return "rename_node"
+	case MoveNodeOp:
+		return "move_node"
+	case DeleteNodeOp:
+		return "delete_node"
+	case RestoreNodeOp:
+		return "restore_node"
+	case UpdateBookmarkOp:
+		return "update_bookmark"
+	case UpdateFolderOp:
+		return "update_folder"
+	case AddTagsOp:
+		return "add_tags"
+	case RemoveTagsOp:
+		return "remove_tags"
+	case SaveSessionOp:
+		return "save_session"
+	case MergeDuplicatesOp:
+		return "merge_duplicates"
+	case SortChildrenOp:
+		return "sort_children"
+	case CopyNodeOp:
+		return "copy_node"
+	case ReplaceOp:
+		return "replace"
+	case MergeFoldersOp:
+		return "merge_folders"
+	case PutNodesOp:
+		return "put_nodes"
+	default:
+		return "unknown"
+	}
+}
+
+type opRecord struct {
+	Type string          `json:"type"`
+	Op   json.RawMessage `json:"op"`
+}
+
+// MarshalOps encodes a batch as a JSON array of {"type", "op"} records.
+func MarshalOps(ops []Op) ([]byte, error) {
+	records := make([]opRecord, 0, len(ops))
+	for _, op := range ops {
+		typ := OpType(op)
+		if _, ok := opDecoders[typ]; !ok {
+			return nil, fmt.Errorf("unsupported op %T", op)
+		}
+		body, err := json.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, opRecord{Type: typ, Op: body})
+	}
+	return json.Marshal(records)
+}
+
+// UnmarshalOps decodes a batch encoded by MarshalOps.
+func UnmarshalOps(data []byte) ([]Op, error) {
+	var records []opRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	ops := make([]Op, 0, len(records))
+	for _, rec := range records {
+		decode, ok := opDecoders[rec.Type]
+		if !ok {
+			return nil, fmt.Errorf("unsupported op type %q", rec.Type)
+		}
+		op, err := decode(rec.Op)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %w", rec.Type, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
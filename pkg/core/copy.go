@@ -0,0 +1,52 @@
+package core
+
+import "fmt"
+
+// MaxCopyNodes bounds how many nodes a single CopyNodeOp may create.
+const MaxCopyNodes = 10000
+
+// validateCopy checks a CopyNodeOp at batch index i and records the copies in
+// the state. The copy is taken from the subtree as it stands before the op,
+// so copying a folder into its own descendant duplicates it exactly once.
+func (s *treeState) validateCopy(i int, op CopyNodeOp) error {
+	node, err := s.requireNode(op.NodeID)
+	if err != nil {
+		return err
+	}
+	if isSystemNode(node.ID) {
+		return ErrRootImmutable
+	}
+	if s.isDescendant(node.ID, TrashID) {
+		return ErrInvalidNode
+	}
+	if err := s.requireParentFolder(op.NewParentID); err != nil {
+		return err
+	}
+	if err := validateIndex(op.NewIndex, len(s.children[op.NewParentID])); err != nil {
+		return err
+	}
+	// Collect the subtree parents-first before adding anything, since the
+	// destination may lie inside it.
+	subtree := []string{node.ID}
+	for j := 0; j < len(subtree); j++ {
+		subtree = append(subtree, s.children[subtree[j]]...)
+		if len(subtree) > MaxCopyNodes {
+			return ErrCopyTooLarge
+		}
+	}
+	keys := make(map[string]string, len(subtree))
+	keys[node.ID] = newNodeKey(i, op.TempID)
+	for j, id := range subtree {
+		orig := s.nodes[id]
+		parentID := op.NewParentID
+		if j > 0 {
+			keys[id] = fmt.Sprintf("#%d:%s", i, id)
+			parentID = keys[*orig.ParentID]
+		}
+		if err := s.addNode(keys[id], orig.Kind, parentID); err != nil {
+			return err
+		}
+		s.nodes[keys[id]].Title, s.nodes[keys[id]].URL = orig.Title, orig.URL
+	}
+	return nil
+}
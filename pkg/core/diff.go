@@ -0,0 +1,341 @@
+package core
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Diff returns ops that turn old into new when validated and applied to old.
+// Nodes are matched by ID. Nodes only in new are added with their ID as the
+// temp ID, so the store assigns them fresh IDs; nodes only in old are
+// deleted; nodes in both are moved, renamed, and updated as needed. Inside
+// the trash only membership and parents are reproduced, not sibling order:
+// nodes newly trashed are soft-deleted, and trashed nodes missing from old
+// are added under the root and soft-deleted.
+//
+// Ops come in a fixed order: additions and moves top-down through the live
+// tree, each followed by the node's content updates, then the trash, then
+// deletes. Placing each folder before its children means no move can form a
+// cycle, and moving survivors out before deleting means recursive deletes
+// only remove what new no longer has.
+func Diff(old, new Tree) []Op {
+	d := differ{
+		old:     old,
+		new:     new,
+		cur:     orderedChildren(old),
+		want:    orderedChildren(new),
+		parents: make(map[string]string, len(old.Nodes)),
+	}
+	for id, node := range old.Nodes {
+		if node.ParentID != nil {
+			d.parents[id] = *node.ParentID
+		}
+	}
+	root := new.RootID
+	if root == "" {
+		root = "root"
+	}
+	d.place(root)
+	for _, id := range d.want[TrashID] {
+		d.trash(id, root)
+	}
+	var deleted []string
+	for id, node := range old.Nodes {
+		if _, ok := new.Nodes[id]; ok || isSystemNode(id) || node.ParentID == nil {
+			continue
+		}
+		// Descendants go with their topmost deleted ancestor.
+		if _, ok := new.Nodes[*node.ParentID]; ok {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted)
+	for _, id := range deleted {
+		d.ops = append(d.ops, DeleteNodeOp{NodeID: id, Recursive: true})
+	}
+	return d.ops
+}
+
+type differ struct {
+	old, new Tree
+	// cur tracks each folder's children in old as the ops so far leave them.
+	cur     map[string][]string
+	want    map[string][]string
+	parents map[string]string
+	ops     []Op
+}
+
+// place emits the ops that give folder its children from new, in order, and
+// recurses into them. Each child goes right after the one before it; the
+// longest run of children already in the right relative order stays put, so
+// a reorder costs as few moves as possible.
+func (d *differ) place(folder string) {
+	keep := d.inOrder(folder)
+	anchor := ""
+	for _, id := range d.want[folder] {
+		node := d.new.Nodes[id]
+		prev, existed := d.old.Nodes[id]
+		at := 0
+		if anchor != "" {
+			at = indexOf(d.cur[folder], anchor) + 1
+		}
+		switch {
+		case !existed:
+			d.ops = append(d.ops, addOps(node, folder, at)...)
+			d.insert(folder, at, id)
+		case d.parents[id] == folder && (keep[id] || d.nextStaying(folder, at) == id):
+			// Already after the anchor, ignoring siblings that are leaving.
+		default:
+			idx := at
+			d.ops = append(d.ops, MoveNodeOp{NodeID: id, NewParentID: folder, NewIndex: &idx})
+			// The store inserts before the sibling now at idx, counting the
+			// node itself when it is already in this folder.
+			if d.parents[id] == folder && indexOf(d.cur[folder], id) < at {
+				at--
+			}
+			d.remove(d.parents[id], id)
+			d.insert(folder, at, id)
+		}
+		if existed {
+			d.ops = append(d.ops, updateOps(prev, node, id)...)
+		}
+		anchor = id
+		if node.Kind == KindFolder {
+			d.place(id)
+		}
+	}
+}
+
+// trash puts id, a direct child of the trash in new, into the trash and then
+// gives its subtree the parents it has in new. Nodes that cannot be created
+// in the trash directly are created under root first.
+func (d *differ) trash(id, root string) {
+	node := d.new.Nodes[id]
+	prev, existed := d.old.Nodes[id]
+	switch {
+	case !existed:
+		d.ops = append(d.ops, addOps(node, root, len(d.cur[root]))...)
+	case d.parents[id] == TrashID:
+	default:
+		if IsTrashed(d.old, id) {
+			// Deeper in the trash; soft-deleting it there would purge it.
+			d.ops = append(d.ops, MoveNodeOp{NodeID: id, NewParentID: root})
+		}
+	}
+	if !existed || d.parents[id] != TrashID {
+		d.ops = append(d.ops, DeleteNodeOp{NodeID: id, Recursive: true, Soft: true})
+		d.remove(d.parents[id], id)
+		d.insert(TrashID, len(d.cur[TrashID]), id)
+	}
+	if existed {
+		d.ops = append(d.ops, updateOps(prev, node, id)...)
+	}
+	d.refile(id)
+}
+
+// refile gives the children of folder, which is in the trash, the parents
+// they have in new, appending where needed.
+func (d *differ) refile(folder string) {
+	for _, id := range d.want[folder] {
+		node := d.new.Nodes[id]
+		prev, existed := d.old.Nodes[id]
+		switch {
+		case !existed:
+			d.ops = append(d.ops, addOps(node, folder, len(d.cur[folder]))...)
+			d.insert(folder, len(d.cur[folder]), id)
+		case d.parents[id] != folder:
+			d.ops = append(d.ops, MoveNodeOp{NodeID: id, NewParentID: folder})
+			d.remove(d.parents[id], id)
+			d.insert(folder, len(d.cur[folder]), id)
+		}
+		if existed {
+			d.ops = append(d.ops, updateOps(prev, node, id)...)
+		}
+		if node.Kind == KindFolder {
+			d.refile(id)
+		}
+	}
+}
+
+// inOrder returns the children folder keeps from old that form the longest
+// subsequence already ordered as in new.
+func (d *differ) inOrder(folder string) map[string]bool {
+	var ids []string
+	var pos []int
+	for _, id := range d.want[folder] {
+		if d.parents[id] == folder {
+			ids = append(ids, id)
+			pos = append(pos, indexOf(d.cur[folder], id))
+		}
+	}
+	// Patience sorting: tails[k] is the index into pos ending the best
+	// increasing run of length k+1; links chain each entry to its
+	// predecessor.
+	tails := make([]int, 0, len(pos))
+	links := make([]int, len(pos))
+	for i, p := range pos {
+		k := sort.Search(len(tails), func(k int) bool { return pos[tails[k]] >= p })
+		links[i] = -1
+		if k > 0 {
+			links[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	keep := make(map[string]bool, len(tails))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = links[i] {
+			keep[ids[i]] = true
+		}
+	}
+	return keep
+}
+
+// nextStaying returns the first child of folder at or after position at that
+// new also places in folder.
+func (d *differ) nextStaying(folder string, at int) string {
+	list := d.cur[folder]
+	for ; at < len(list); at++ {
+		if node, ok := d.new.Nodes[list[at]]; ok && node.ParentID != nil && *node.ParentID == folder {
+			return list[at]
+		}
+	}
+	return ""
+}
+
+func indexOf(list []string, id string) int {
+	for i, v := range list {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *differ) insert(folder string, i int, id string) {
+	list := d.cur[folder]
+	list = append(list, "")
+	copy(list[i+1:], list[i:])
+	list[i] = id
+	d.cur[folder] = list
+	d.parents[id] = folder
+}
+
+func (d *differ) remove(folder, id string) {
+	list := d.cur[folder]
+	for i, child := range list {
+		if child == id {
+			d.cur[folder] = append(list[:i:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+// addOps creates node under parent at index i, then sets the fields the add
+// ops do not carry.
+func addOps(node Node, parent string, i int) []Op {
+	idx := i
+	var ops []Op
+	switch node.Kind {
+	case KindFolder:
+		ops = append(ops, AddFolderOp{ParentID: parent, Title: node.Title, Index: &idx, TempID: node.ID})
+	case KindBookmark:
+		url := ""
+		if node.URL != nil {
+			url = *node.URL
+		}
+		ops = append(ops, AddBookmarkOp{ParentID: parent, Title: node.Title, URL: url, Index: &idx, TempID: node.ID})
+	case KindSeparator:
+		ops = append(ops, AddSeparatorOp{ParentID: parent, Index: &idx, TempID: node.ID})
+	case KindSmart:
+		var query SmartQuery
+		if node.Query != nil {
+			query = *node.Query
+		}
+		ops = append(ops, AddSmartFolderOp{ParentID: parent, Title: node.Title, Query: query, Index: &idx, TempID: node.ID})
+	}
+	blank := Node{Kind: node.Kind, Title: node.Title, URL: node.URL, Query: node.Query}
+	return append(ops, updateOps(blank, node, node.ID)...)
+}
+
+// updateOps returns the ops that change prev's content into next's.
+func updateOps(prev, next Node, id string) []Op {
+	if isSystemNode(id) || next.Kind == KindSeparator {
+		return nil
+	}
+	var ops []Op
+	if prev.Title != next.Title {
+		ops = append(ops, RenameNodeOp{NodeID: id, Title: next.Title})
+	}
+	var notes *string
+	if prev.Notes != next.Notes {
+		n := next.Notes
+		notes = &n
+	}
+	switch next.Kind {
+	case KindBookmark:
+		var url *string
+		if next.URL != nil && (prev.URL == nil || *prev.URL != *next.URL) {
+			u := *next.URL
+			url = &u
+		}
+		if url != nil || notes != nil {
+			ops = append(ops, UpdateBookmarkOp{NodeID: id, URL: url, Notes: notes})
+		}
+	case KindFolder, KindSmart:
+		var query *SmartQuery
+		if next.Kind == KindSmart && next.Query != nil && !reflect.DeepEqual(prev.Query, next.Query) {
+			q := *next.Query
+			query = &q
+		}
+		if notes != nil || query != nil {
+			ops = append(ops, UpdateFolderOp{NodeID: id, Notes: notes, Query: query})
+		}
+	}
+	if added := tagsMissing(prev.Tags, next.Tags); len(added) > 0 {
+		ops = append(ops, AddTagsOp{NodeID: id, Tags: added})
+	}
+	if removed := tagsMissing(next.Tags, prev.Tags); len(removed) > 0 {
+		ops = append(ops, RemoveTagsOp{NodeID: id, Tags: removed})
+	}
+	return ops
+}
+
+// tagsMissing returns the tags in want that have does not carry.
+func tagsMissing(have, want []string) []string {
+	set := make(map[string]bool, len(have))
+	for _, tag := range have {
+		set[tag] = true
+	}
+	var out []string
+	for _, tag := range want {
+		if !set[tag] {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// orderedChildren lists each folder's children by ord, breaking ties by ID as
+// the store does.
+func orderedChildren(tree Tree) map[string][]string {
+	out := make(map[string][]string)
+	for id, node := range tree.Nodes {
+		if node.ParentID != nil {
+			out[*node.ParentID] = append(out[*node.ParentID], id)
+		}
+	}
+	for _, ids := range out {
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := tree.Nodes[ids[i]], tree.Nodes[ids[j]]
+			if a.Ord != b.Ord {
+				return a.Ord < b.Ord
+			}
+			return a.ID < b.ID
+		})
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package core
+
+// MergeStrategy selects which bookmark a MergeDuplicatesOp keeps.
+type MergeStrategy string
+
+const (
+	// MergeOldest keeps the earliest created bookmark. It is the default.
+	MergeOldest MergeStrategy = "oldest"
+	// MergeNewest keeps the most recently created bookmark.
+	MergeNewest MergeStrategy = "newest"
+	// MergeDeepest keeps the bookmark nested deepest in the folder tree,
+	// on the basis that it was filed most deliberately.
+	MergeDeepest MergeStrategy = "deepest"
+)
+
+func (m MergeStrategy) valid() bool {
+	switch m {
+	case "", MergeOldest, MergeNewest, MergeDeepest:
+		return true
+	}
+	return false
+}
+
+// MergeCandidate describes one bookmark considered by PickSurvivor. Depth is
+// the number of ancestors, so children of the root have depth 1.
+type MergeCandidate struct {
+	ID        string
+	CreatedAt int64
+	Depth     int
+}
+
+// PickSurvivor returns the ID of the candidate strategy keeps. Ties fall back
+// to the oldest candidate, then the lowest ID, so the choice is deterministic.
+func PickSurvivor(candidates []MergeCandidate, strategy MergeStrategy) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if survivorBefore(c, best, strategy) {
+			best = c
+		}
+	}
+	return best.ID
+}
+
+func survivorBefore(a, b MergeCandidate, strategy MergeStrategy) bool {
+	switch strategy {
+	case MergeNewest:
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+	case MergeDeepest:
+		if a.Depth != b.Depth {
+			return a.Depth > b.Depth
+		}
+	}
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+// validateMerge checks a MergeDuplicatesOp and removes the bookmarks it
+// deletes from the state.
+func (s *treeState) validateMerge(op MergeDuplicatesOp) error {
+	if len(op.NodeIDs) < 2 || !op.Strategy.valid() {
+		return ErrInvalidMerge
+	}
+	var (
+		canonical  string
+		candidates = make([]MergeCandidate, 0, len(op.NodeIDs))
+		seen       = make(map[string]bool, len(op.NodeIDs))
+	)
+	for _, id := range op.NodeIDs {
+		node, err := s.requireNode(id)
+		if err != nil {
+			return err
+		}
+		if node.Kind != KindBookmark || s.isDescendant(id, TrashID) {
+			return ErrInvalidNode
+		}
+		if seen[id] || node.CanonicalURL == nil {
+			return ErrInvalidMerge
+		}
+		seen[id] = true
+		if canonical == "" {
+			canonical = *node.CanonicalURL
+		} else if *node.CanonicalURL != canonical {
+			return ErrInvalidMerge
+		}
+		candidates = append(candidates, MergeCandidate{ID: id, CreatedAt: node.CreatedAt, Depth: s.depth(id)})
+	}
+	survivor := PickSurvivor(candidates, op.Strategy)
+	for _, id := range op.NodeIDs {
+		if id == survivor {
+			continue
+		}
+		if op.Soft {
+			s.moveNode(id, TrashID)
+		} else {
+			s.deleteNode(id)
+		}
+	}
+	return nil
+}
+
+// depth counts the ancestors of id.
+func (s *treeState) depth(id string) int {
+	depth := 0
+	for node := s.nodes[id]; node != nil && node.ParentID != nil; node = s.nodes[*node.ParentID] {
+		depth++
+	}
+	return depth
+}
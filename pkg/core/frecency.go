@@ -0,0 +1,25 @@
+package core
+
+import (
+	"math"
+	"time"
+)
+
+// FrecencyHalfLife is how long it takes a bookmark's frecency to halve when
+// it is not visited.
+const FrecencyHalfLife = 30 * 24 * time.Hour
+
+// Frecency scores how much a bookmark is used from its visit count and its
+// last visit, in Unix milliseconds: the count decays by half for every
+// FrecencyHalfLife since the last visit, so a link used steadily now ranks
+// above one used heavily long ago. Unvisited bookmarks score 0.
+func Frecency(visits int, lastVisitAt int64, now time.Time) float64 {
+	if visits <= 0 {
+		return 0
+	}
+	age := now.Sub(time.UnixMilli(lastVisitAt))
+	if age < 0 {
+		age = 0
+	}
+	return float64(visits) * math.Exp2(-float64(age)/float64(FrecencyHalfLife))
+}
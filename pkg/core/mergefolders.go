@@ -0,0 +1,76 @@
+package core
+
+// validateMergeFolders checks a MergeFoldersOp and applies its effect to the
+// state: the source's children move under the target, duplicates dropped
+// with Dedupe are removed, and the emptied source is removed.
+func (s *treeState) validateMergeFolders(op MergeFoldersOp) error {
+	source, err := s.requireNode(op.SourceID)
+	if err != nil {
+		return err
+	}
+	if isSystemNode(source.ID) {
+		return ErrRootImmutable
+	}
+	if source.Kind != KindFolder || s.isDescendant(source.ID, TrashID) {
+		return ErrInvalidNode
+	}
+	if err := s.requireParentFolder(op.TargetID); err != nil {
+		return err
+	}
+	if s.isDescendant(op.TargetID, TrashID) {
+		return ErrInvalidParent
+	}
+	// Merging a folder into itself or its own subtree would leave the
+	// target inside the source that is removed afterwards.
+	if s.isDescendant(op.TargetID, source.ID) {
+		return ErrCycleDetected
+	}
+
+	seen := make(map[string]bool)
+	if op.Dedupe {
+		for _, id := range s.children[op.TargetID] {
+			if key := urlKey(s.nodes[id]); key != "" {
+				seen[key] = true
+			}
+		}
+	}
+	for _, id := range append([]string(nil), s.children[source.ID]...) {
+		if op.Dedupe {
+			// Bookmarks added earlier in the batch have no canonical URL yet,
+			// so they only match on their exact URL.
+			if key := urlKey(s.nodes[id]); key != "" {
+				if seen[key] {
+					s.removeNode(id, op.Soft)
+					continue
+				}
+				seen[key] = true
+			}
+		}
+		s.moveNode(id, op.TargetID)
+	}
+	s.removeNode(source.ID, op.Soft)
+	return nil
+}
+
+// urlKey is the value MergeFoldersOp dedupes bookmarks by: the canonical URL
+// when known, otherwise the URL. Other kinds have none.
+func urlKey(node *Node) string {
+	switch {
+	case node.Kind != KindBookmark:
+		return ""
+	case node.CanonicalURL != nil:
+		return *node.CanonicalURL
+	case node.URL != nil:
+		return *node.URL
+	}
+	return ""
+}
+
+// removeNode deletes id from the state, or moves it to the trash when soft.
+func (s *treeState) removeNode(id string, soft bool) {
+	if soft {
+		s.moveNode(id, TrashID)
+	} else {
+		s.deleteNode(id)
+	}
+}
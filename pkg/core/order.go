@@ -19,3 +19,9 @@ func NextOrd(value float64) float64 {
 func PrevOrd(value float64) float64 {
 	return value - 1
 }
+
+// NeedsRebalance reports whether the gap between adjacent ords has shrunk
+// below OrdEpsilon, at which point midpoints stop being distinguishable.
+func NeedsRebalance(lo, hi float64) bool {
+	return hi-lo < OrdEpsilon
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrInvalidPath indicates a path that is not absolute, has an empty
+	// segment, or uses an unknown escape.
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrPathNotFound indicates a path segment no child title matches.
+	ErrPathNotFound = errors.New("path not found")
+	// ErrAmbiguousPath indicates a path segment several siblings match.
+	ErrAmbiguousPath = errors.New("ambiguous path")
+)
+
+// PathError reports where resolving a path failed. Segment is the unescaped
+// title that did not resolve; Matches lists the sibling IDs it matched when
+// Err is ErrAmbiguousPath.
+type PathError struct {
+	Path    string
+	Segment string
+	Matches []string
+	Err     error
+}
+
+func (e *PathError) Error() string {
+	if len(e.Matches) > 0 {
+		return fmt.Sprintf("%s: %v: %q matches %s", e.Path, e.Err, e.Segment, strings.Join(e.Matches, ", "))
+	}
+	if e.Segment != "" {
+		return fmt.Sprintf("%s: %v: %q", e.Path, e.Err, e.Segment)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// IsPath reports whether ref is a title path such as "/Work/Infra" rather
+// than a node ID. Node IDs never start with "/", and ValidateOps rejects
+// temp IDs that do.
+func IsPath(ref string) bool {
+	return strings.HasPrefix(ref, "/")
+}
+
+// EscapePathSegment escapes a title for use as one path segment: "/" becomes
+// "\/" and "\" becomes "\\".
+func EscapePathSegment(title string) string {
+	return strings.NewReplacer(`\`, `\\`, `/`, `\/`).Replace(title)
+}
+
+// SplitPath returns the unescaped titles of an absolute path. "/" is the
+// root and yields none; a single trailing slash is ignored.
+func SplitPath(path string) ([]string, error) {
+	if !IsPath(path) {
+		return nil, &PathError{Path: path, Err: ErrInvalidPath}
+	}
+	rest := strings.TrimPrefix(path, "/")
+	if rest == "" {
+		return nil, nil
+	}
+	var segments []string
+	var seg strings.Builder
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; c {
+		case '\\':
+			if i+1 == len(rest) || (rest[i+1] != '/' && rest[i+1] != '\\') {
+				return nil, &PathError{Path: path, Err: ErrInvalidPath}
+			}
+			i++
+			seg.WriteByte(rest[i])
+		case '/':
+			if seg.Len() == 0 {
+				return nil, &PathError{Path: path, Err: ErrInvalidPath}
+			}
+			segments = append(segments, seg.String())
+			seg.Reset()
+		default:
+			seg.WriteByte(c)
+		}
+	}
+	if seg.Len() > 0 {
+		segments = append(segments, seg.String())
+	}
+	return segments, nil
+}
+
+// ResolvePath returns the ID of the node path names, matching each segment
+// against the exact titles of the previous node's children. Separators have
+// no title and are never matched; the trash is not reachable by path.
+func ResolvePath(tree Tree, path string) (string, error) {
+	segments, err := SplitPath(path)
+	if err != nil {
+		return "", err
+	}
+	root := tree.RootID
+	if root == "" {
+		root = "root"
+	}
+	children := tree.Children
+	if children == nil {
+		children = orderedChildren(tree)
+	}
+	current := root
+	for _, seg := range segments {
+		var matches []string
+		for _, id := range children[current] {
+			if node := tree.Nodes[id]; node.Kind != KindSeparator && node.Title == seg {
+				matches = append(matches, id)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return "", &PathError{Path: path, Segment: seg, Err: ErrPathNotFound}
+		case 1:
+			current = matches[0]
+		default:
+			sort.Strings(matches)
+			return "", &PathError{Path: path, Segment: seg, Matches: matches, Err: ErrAmbiguousPath}
+		}
+	}
+	return current, nil
+}
+
+// Breadcrumb is one ancestor of a node, as shown in a location trail.
+type Breadcrumb struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// Breadcrumbs returns the ancestors of id from the topmost folder below the
+// root (or the trash itself for trashed nodes) down to its parent.
+func Breadcrumbs(tree Tree, id string) []Breadcrumb {
+	crumbs := make([]Breadcrumb, 0)
+	node, ok := tree.Nodes[id]
+	for ok && node.ParentID != nil {
+		parent, found := tree.Nodes[*node.ParentID]
+		if !found || (parent.ParentID == nil && parent.ID != TrashID) {
+			break
+		}
+		crumbs = append(crumbs, Breadcrumb{ID: parent.ID, Title: parent.Title})
+		node = parent
+	}
+	for i, j := 0, len(crumbs)-1; i < j; i, j = i+1, j-1 {
+		crumbs[i], crumbs[j] = crumbs[j], crumbs[i]
+	}
+	return crumbs
+}
+
+// NodePath returns the escaped path of id below the root, the inverse of
+// ResolvePath when sibling titles are unique. It returns "" for the trash
+// and nodes inside it.
+func NodePath(tree Tree, id string) string {
+	if IsTrashed(tree, id) {
+		return ""
+	}
+	var b strings.Builder
+	for _, crumb := range Breadcrumbs(tree, id) {
+		b.WriteString("/" + EscapePathSegment(crumb.Title))
+	}
+	if node, ok := tree.Nodes[id]; ok && node.ParentID != nil {
+		b.WriteString("/" + EscapePathSegment(node.Title))
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
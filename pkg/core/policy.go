@@ -0,0 +1,122 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrSchemeNotAllowed indicates a URL whose scheme the profile does not
+// allow. It wraps ErrInvalidURL.
+var ErrSchemeNotAllowed = fmt.Errorf("%w: scheme not allowed", ErrInvalidURL)
+
+// SchemeError reports a URL scheme outside the allowed set.
+type SchemeError struct {
+	Scheme  string
+	Allowed []string
+}
+
+func (e *SchemeError) Error() string {
+	return fmt.Sprintf("url scheme %q not allowed; allowed schemes: %s", e.Scheme, strings.Join(e.Allowed, ", "))
+}
+
+func (e *SchemeError) Unwrap() error {
+	return ErrSchemeNotAllowed
+}
+
+// ValidationPolicy holds the per-profile rules ValidateOps enforces on top of
+// the structural checks.
+type ValidationPolicy struct {
+	// AllowedSchemes lists the lowercase URL schemes bookmarks may use.
+	AllowedSchemes []string
+	// Maximum lengths of text fields in characters; 0 disables the limit.
+	// Profile configs never pass 0, since config.LimitsConfig reads it as
+	// the default.
+	MaxTitleLength int
+	MaxURLLength   int
+	MaxNotesLength int
+	MaxTagLength   int
+}
+
+// DefaultValidationPolicy allows only http and https URLs and applies the
+// default text limits.
+func DefaultValidationPolicy() ValidationPolicy {
+	return ValidationPolicy{
+		AllowedSchemes: []string{"http", "https"},
+		MaxTitleLength: DefaultMaxTitleLength,
+		MaxURLLength:   DefaultMaxURLLength,
+		MaxNotesLength: DefaultMaxNotesLength,
+		MaxTagLength:   DefaultMaxTagLength,
+	}
+}
+
+// schemeRules checks the part of a URL after "scheme:" for schemes with
+// known structure. Other allowed schemes only need a non-empty remainder.
+var schemeRules = map[string]func(raw string) bool{
+	"http":       requireHost,
+	"https":      requireHost,
+	"ftp":        requireHost,
+	"file":       requirePath,
+	"javascript": func(raw string) bool { return strings.TrimSpace(afterScheme(raw)) != "" },
+}
+
+func requireHost(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Host != ""
+}
+
+func requirePath(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && strings.HasPrefix(u.Path, "/")
+}
+
+func afterScheme(raw string) string {
+	_, rest, _ := strings.Cut(raw, ":")
+	return rest
+}
+
+// urlScheme returns the lowercase scheme of raw, or "" when raw has none.
+// It does not parse the rest, so bookmarklets with arbitrary script text
+// still yield a scheme.
+func urlScheme(raw string) string {
+	scheme, _, ok := strings.Cut(raw, ":")
+	if !ok || scheme == "" {
+		return ""
+	}
+	for i, r := range scheme {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return ""
+		}
+	}
+	return strings.ToLower(scheme)
+}
+
+// validateURL checks raw against the policy's allowed schemes and the rules
+// for its scheme.
+func (p ValidationPolicy) validateURL(raw string) error {
+	scheme := urlScheme(raw)
+	if scheme == "" {
+		return ErrInvalidURL
+	}
+	allowed := false
+	for _, s := range p.AllowedSchemes {
+		if strings.EqualFold(s, scheme) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return &SchemeError{Scheme: scheme, Allowed: p.AllowedSchemes}
+	}
+	check, ok := schemeRules[scheme]
+	if !ok {
+		check = func(raw string) bool { return afterScheme(raw) != "" }
+	}
+	if !check(raw) {
+		return ErrInvalidURL
+	}
+	return nil
+}
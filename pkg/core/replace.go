@@ -0,0 +1,147 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ReplaceField names a node field ReplaceOp rewrites.
+type ReplaceField string
+
+const (
+	ReplaceTitle ReplaceField = "title"
+	ReplaceURL   ReplaceField = "url"
+)
+
+// Replacement is one field rewrite planned by a ReplaceOp.
+type Replacement struct {
+	NodeID string       `json:"nodeId"`
+	Field  ReplaceField `json:"field"`
+	Old    string       `json:"old"`
+	New    string       `json:"new"`
+}
+
+// Replacer returns the function op applies to each field value: a literal
+// replacement of every occurrence of Find, or with Regex a regular expression
+// replacement where Replace may reference groups as $1 or ${name}.
+func (op ReplaceOp) Replacer() (func(string) string, error) {
+	if op.Find == "" {
+		return nil, ErrInvalidReplace
+	}
+	if !op.Regex {
+		return func(s string) string { return strings.ReplaceAll(s, op.Find, op.Replace) }, nil
+	}
+	re, err := regexp.Compile(op.Find)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReplace, err)
+	}
+	return func(s string) string { return re.ReplaceAllString(s, op.Replace) }, nil
+}
+
+// Targets reports which fields op rewrites. No fields means both.
+func (op ReplaceOp) Targets() (title, url bool, err error) {
+	if len(op.Fields) == 0 {
+		return true, true, nil
+	}
+	for _, f := range op.Fields {
+		switch f {
+		case ReplaceTitle:
+			title = true
+		case ReplaceURL:
+			url = true
+		default:
+			return false, false, ErrInvalidReplace
+		}
+	}
+	return title, url, nil
+}
+
+// PlanReplace lists the rewrites op makes in tree, in tree order. The trash
+// is skipped unless op is scoped inside it.
+func PlanReplace(tree Tree, op ReplaceOp) ([]Replacement, error) {
+	if _, ok := tree.Nodes[op.NodeID]; !ok {
+		return nil, ErrInvalidNode
+	}
+	return planReplace(op, func(id string) *Node {
+		node := tree.Nodes[id]
+		return &node
+	}, func(id string) []string { return tree.Children[id] })
+}
+
+func planReplace(op ReplaceOp, node func(id string) *Node, children func(id string) []string) ([]Replacement, error) {
+	rewrite, err := op.Replacer()
+	if err != nil {
+		return nil, err
+	}
+	doTitle, doURL, err := op.Targets()
+	if err != nil {
+		return nil, err
+	}
+	var out []Replacement
+	var walk func(id string)
+	walk = func(id string) {
+		n := node(id)
+		if doTitle && !isSystemNode(id) && n.Kind != KindSeparator {
+			if title := rewrite(n.Title); title != n.Title {
+				out = append(out, Replacement{NodeID: id, Field: ReplaceTitle, Old: n.Title, New: title})
+			}
+		}
+		if doURL && n.Kind == KindBookmark && n.URL != nil {
+			if url := rewrite(*n.URL); url != *n.URL {
+				out = append(out, Replacement{NodeID: id, Field: ReplaceURL, Old: *n.URL, New: url})
+			}
+		}
+		for _, child := range children(id) {
+			if child == TrashID && op.NodeID != TrashID {
+				continue
+			}
+			walk(child)
+		}
+	}
+	walk(op.NodeID)
+	return out, nil
+}
+
+// validateReplace checks that every rewrite of a ReplaceOp still passes the
+// text and URL rules and records the new values in the state.
+func (s *treeState) validateReplace(op ReplaceOp) error {
+	if _, err := s.requireNode(op.NodeID); err != nil {
+		return err
+	}
+	plan, err := planReplace(op, func(id string) *Node { return s.nodes[id] }, func(id string) []string { return s.children[id] })
+	if err != nil {
+		return err
+	}
+	for _, r := range plan {
+		node := s.nodes[r.NodeID]
+		field := fmt.Sprintf("nodes[%s].%s", r.NodeID, r.Field)
+		if r.Field == ReplaceURL {
+			if err := s.policy.checkURL(field, r.New); err != nil {
+				var ferr *FieldError
+				if !errors.As(err, &ferr) {
+					// Name the rewritten node; a batch may touch hundreds.
+					err = &FieldError{Field: field, Err: err}
+				}
+				return err
+			}
+			if !op.DryRun {
+				url := r.New
+				node.URL, node.CanonicalURL = &url, nil
+			}
+			continue
+		}
+		kind := textName
+		if node.Kind == KindBookmark {
+			kind = textLine
+		}
+		if err := s.policy.checkTitle(field, r.New, kind); err != nil {
+			return err
+		}
+		if !op.DryRun {
+			node.Title = r.New
+		}
+	}
+	return nil
+}
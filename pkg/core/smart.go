@@ -0,0 +1,81 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// SmartQuery is the saved search behind a smart folder. All set criteria must
+// match.
+type SmartQuery struct {
+	// Text matches case-insensitively against title, URL, canonical URL,
+	// and notes.
+	Text string `json:"text,omitempty"`
+	// Tags lists tags a node must carry, all of them.
+	Tags []string `json:"tags,omitempty"`
+	// AddedWithinDays keeps nodes created in the last N days; 0 disables it.
+	AddedWithinDays int `json:"addedWithinDays,omitempty"`
+}
+
+// Matches reports whether node satisfies the query as of now.
+func (q SmartQuery) Matches(node Node, now time.Time) bool {
+	if !HasTags(node, q.Tags) {
+		return false
+	}
+	if q.AddedWithinDays > 0 {
+		cutoff := now.Add(-time.Duration(q.AddedWithinDays) * 24 * time.Hour).UnixMilli()
+		if node.CreatedAt < cutoff {
+			return false
+		}
+	}
+	if q.Text == "" {
+		return true
+	}
+	text := strings.ToLower(q.Text)
+	return strings.Contains(strings.ToLower(node.Title), text) ||
+		(node.URL != nil && strings.Contains(strings.ToLower(*node.URL), text)) ||
+		(node.CanonicalURL != nil && strings.Contains(strings.ToLower(*node.CanonicalURL), text)) ||
+		strings.Contains(strings.ToLower(node.Notes), text)
+}
+
+// ResolveSmartFolder evaluates the query of smart folder id and returns the
+// IDs of matching bookmarks outside the trash, newest first.
+func ResolveSmartFolder(tree Tree, id string, now time.Time) ([]string, error) {
+	folder, ok := tree.Nodes[id]
+	if !ok || folder.Kind != KindSmart || folder.Query == nil {
+		return nil, ErrInvalidNode
+	}
+	var ids []string
+	for _, node := range tree.Nodes {
+		if node.Kind != KindBookmark || IsTrashed(tree, node.ID) {
+			continue
+		}
+		if folder.Query.Matches(node, now) {
+			ids = append(ids, node.ID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := tree.Nodes[ids[i]], tree.Nodes[ids[j]]
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+		return a.ID < b.ID
+	})
+	return ids, nil
+}
+
+func validateQuery(q SmartQuery) error {
+	if q.Text == "" && len(q.Tags) == 0 && q.AddedWithinDays == 0 {
+		return ErrInvalidQuery
+	}
+	if q.AddedWithinDays < 0 {
+		return ErrInvalidQuery
+	}
+	if len(q.Tags) > 0 {
+		if err := validateTags(q.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
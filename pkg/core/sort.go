@@ -0,0 +1,86 @@
+package core
+
+import (
+	"sort"
+	"strings"
+)
+
+// SortKey selects the field SortChildrenOp orders by.
+type SortKey string
+
+const (
+	SortByTitle   SortKey = "title"
+	SortByURL     SortKey = "url"
+	SortByCreated SortKey = "created"
+	SortByUpdated SortKey = "updated"
+)
+
+func (k SortKey) valid() bool {
+	switch k {
+	case SortByTitle, SortByURL, SortByCreated, SortByUpdated:
+		return true
+	}
+	return false
+}
+
+// kindRank orders kinds for SortChildrenOp.KindFirst: folders, then
+// bookmarks, then separators.
+func kindRank(kind NodeKind) int {
+	switch kind {
+	case KindFolder, KindSmart:
+		return 0
+	case KindBookmark:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// SortNodes orders nodes in place as op describes. The sort is stable, so
+// nodes that compare equal keep their current relative order. Titles and
+// URLs compare case-insensitively.
+func SortNodes(nodes []Node, op SortChildrenOp) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if op.KindFirst {
+			if ra, rb := kindRank(a.Kind), kindRank(b.Kind); ra != rb {
+				return ra < rb
+			}
+		}
+		c := compareSortKey(a, b, op.By)
+		if op.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func compareSortKey(a, b Node, key SortKey) int {
+	switch key {
+	case SortByURL:
+		return strings.Compare(strings.ToLower(nodeURL(a)), strings.ToLower(nodeURL(b)))
+	case SortByCreated:
+		return compareInt(a.CreatedAt, b.CreatedAt)
+	case SortByUpdated:
+		return compareInt(a.UpdatedAt, b.UpdatedAt)
+	default:
+		return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	}
+}
+
+func nodeURL(n Node) string {
+	if n.URL == nil {
+		return ""
+	}
+	return *n.URL
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"sort"
+	"strings"
+)
+
+// NormalizeTag trims and lowercases a tag so lookups are case-insensitive.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// NormalizeTags normalizes, de-duplicates, and sorts tags, dropping empties.
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]struct{}, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		t := NormalizeTag(tag)
+		if t == "" {
+			continue
+		}
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// HasTags reports whether node carries every tag in want.
+func HasTags(node Node, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range node.Tags {
+			if t == NormalizeTag(w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func validateTags(tags []string) error {
+	if len(tags) == 0 {
+		return ErrInvalidTag
+	}
+	for _, tag := range tags {
+		t := NormalizeTag(tag)
+		if t == "" || strings.ContainsAny(t, ",\n\t") {
+			return ErrInvalidTag
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package core
+
+// ResolveOpIDs returns op with every node reference (parent, node, and
+// destination IDs) passed through resolve. TempIDs themselves are unchanged.
+func ResolveOpIDs(op Op, resolve func(string) string) Op {
+	switch v := op.(type) {
+	case AddFolderOp:
+		v.ParentID = resolve(v.ParentID)
+		return v
+	case AddBookmarkOp:
+		v.ParentID = resolve(v.ParentID)
+		return v
+	case AddSeparatorOp:
+		v.ParentID = resolve(v.ParentID)
+		return v
+	case AddSmartFolderOp:
+		v.ParentID = resolve(v.ParentID)
+		return v
+	case RenameNodeOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case MoveNodeOp:
+		v.NodeID = resolve(v.NodeID)
+		v.NewParentID = resolve(v.NewParentID)
+		return v
+	case DeleteNodeOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case RestoreNodeOp:
+		v.NodeID = resolve(v.NodeID)
+		if v.ParentID != "" {
+			v.ParentID = resolve(v.ParentID)
+		}
+		return v
+	case UpdateBookmarkOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case UpdateFolderOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case AddTagsOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case RemoveTagsOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case SaveSessionOp:
+		v.ParentID = resolve(v.ParentID)
+		return v
+	case SortChildrenOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case CopyNodeOp:
+		v.NodeID = resolve(v.NodeID)
+		v.NewParentID = resolve(v.NewParentID)
+		return v
+	case ReplaceOp:
+		v.NodeID = resolve(v.NodeID)
+		return v
+	case MergeFoldersOp:
+		v.SourceID = resolve(v.SourceID)
+		v.TargetID = resolve(v.TargetID)
+		return v
+	case MergeDuplicatesOp:
+		ids := make([]string, len(v.NodeIDs))
+		for i, id := range v.NodeIDs {
+			ids[i] = resolve(id)
+		}
+		v.NodeIDs = ids
+		return v
+	default:
+		return op
+	}
+}
+
+// CreatedTempID returns the client-assigned temp ID of the node op creates,
+// or "" when op creates nothing or carries no temp ID.
+func CreatedTempID(op Op) string {
+	switch v := op.(type) {
+	case AddFolderOp:
+		return v.TempID
+	case AddBookmarkOp:
+		return v.TempID
+	case AddSeparatorOp:
+		return v.TempID
+	case AddSmartFolderOp:
+		return v.TempID
+	case SaveSessionOp:
+		return v.TempID
+	case CopyNodeOp:
+		return v.TempID
+	default:
+		return ""
+	}
+}
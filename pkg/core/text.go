@@ -0,0 +1,196 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// ErrInvalidText indicates text that is not valid NFC UTF-8, contains
+	// control characters, or is an empty folder title.
+	ErrInvalidText = errors.New("invalid text")
+	// ErrTextTooLong indicates text longer than the policy allows.
+	ErrTextTooLong = errors.New("text too long")
+)
+
+// FieldError reports which text field of an op failed validation. Limit is
+// the maximum length in characters when Err is ErrTextTooLong.
+type FieldError struct {
+	Field string
+	Limit int
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	if e.Limit > 0 {
+		return fmt.Sprintf("%s: %v (max %d characters)", e.Field, e.Err, e.Limit)
+	}
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Default text limits, in characters.
+const (
+	DefaultMaxTitleLength = 1024
+	DefaultMaxURLLength   = 8192
+	DefaultMaxNotesLength = 65536
+	DefaultMaxTagLength   = 128
+)
+
+// textKind selects the rules checkText applies to a field.
+type textKind int
+
+const (
+	// textLine is single-line text such as a bookmark title.
+	textLine textKind = iota
+	// textName is single-line text that must not be blank, such as a
+	// folder title.
+	textName
+	// textBlock is free text where newlines and tabs are allowed.
+	textBlock
+)
+
+// checkText validates one text field against the policy. limit is the
+// maximum length in characters; 0 disables the check.
+func checkText(field, value string, limit int, kind textKind) error {
+	if !utf8.ValidString(value) || !norm.NFC.IsNormalString(value) {
+		return &FieldError{Field: field, Err: ErrInvalidText}
+	}
+	blank := true
+	for _, r := range value {
+		if unicode.IsControl(r) && !(kind == textBlock && (r == '\n' || r == '\t')) {
+			return &FieldError{Field: field, Err: ErrInvalidText}
+		}
+		if !unicode.IsSpace(r) {
+			blank = false
+		}
+	}
+	if kind == textName && blank {
+		return &FieldError{Field: field, Err: ErrInvalidText}
+	}
+	if limit > 0 && utf8.RuneCountInString(value) > limit {
+		return &FieldError{Field: field, Limit: limit, Err: ErrTextTooLong}
+	}
+	return nil
+}
+
+func (p ValidationPolicy) checkTitle(field, title string, kind textKind) error {
+	return checkText(field, title, p.MaxTitleLength, kind)
+}
+
+func (p ValidationPolicy) checkURL(field, url string) error {
+	if err := checkText(field, url, p.MaxURLLength, textLine); err != nil {
+		return err
+	}
+	return p.validateURL(url)
+}
+
+func (p ValidationPolicy) checkNotes(notes *string) error {
+	if notes == nil {
+		return nil
+	}
+	return checkText("notes", *notes, p.MaxNotesLength, textBlock)
+}
+
+func (p ValidationPolicy) checkQuery(q SmartQuery) error {
+	if err := validateQuery(q); err != nil {
+		return err
+	}
+	if err := checkText("query.text", q.Text, p.MaxTitleLength, textLine); err != nil {
+		return err
+	}
+	return p.checkTags("query.tags", q.Tags)
+}
+
+// checkTags validates tags as they will be stored, after NormalizeTag.
+func (p ValidationPolicy) checkTags(field string, tags []string) error {
+	for _, tag := range tags {
+		if err := checkText(field, NormalizeTag(tag), p.MaxTagLength, textLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeOps returns ops with every client-supplied text field converted to
+// Unicode NFC, the form ValidateOps requires. Ops without text are returned
+// unchanged.
+func NormalizeOps(ops []Op) []Op {
+	out := make([]Op, len(ops))
+	for i, op := range ops {
+		out[i] = normalizeOp(op)
+	}
+	return out
+}
+
+func normalizeOp(op Op) Op {
+	nfc := norm.NFC.String
+	nfcAll := func(ss []string) []string {
+		if ss == nil {
+			return nil
+		}
+		out := make([]string, len(ss))
+		for i, s := range ss {
+			out[i] = nfc(s)
+		}
+		return out
+	}
+	nfcPtr := func(s *string) *string {
+		if s == nil {
+			return nil
+		}
+		v := nfc(*s)
+		return &v
+	}
+	switch v := op.(type) {
+	case AddFolderOp:
+		v.Title = nfc(v.Title)
+		return v
+	case AddBookmarkOp:
+		v.Title, v.URL = nfc(v.Title), nfc(v.URL)
+		return v
+	case AddSmartFolderOp:
+		v.Title, v.Query.Text, v.Query.Tags = nfc(v.Title), nfc(v.Query.Text), nfcAll(v.Query.Tags)
+		return v
+	case RenameNodeOp:
+		v.Title = nfc(v.Title)
+		return v
+	case UpdateBookmarkOp:
+		v.Title, v.URL, v.Notes = nfcPtr(v.Title), nfcPtr(v.URL), nfcPtr(v.Notes)
+		return v
+	case UpdateFolderOp:
+		v.Title, v.Notes = nfcPtr(v.Title), nfcPtr(v.Notes)
+		if v.Query != nil {
+			q := *v.Query
+			q.Text, q.Tags = nfc(q.Text), nfcAll(q.Tags)
+			v.Query = &q
+		}
+		return v
+	case AddTagsOp:
+		v.Tags = nfcAll(v.Tags)
+		return v
+	case RemoveTagsOp:
+		v.Tags = nfcAll(v.Tags)
+		return v
+	case ReplaceOp:
+		v.Find, v.Replace = nfc(v.Find), nfc(v.Replace)
+		return v
+	case SaveSessionOp:
+		v.Title = nfc(v.Title)
+		tabs := make([]Tab, len(v.Tabs))
+		for i, tab := range v.Tabs {
+			tabs[i] = Tab{Title: nfc(tab.Title), URL: nfc(tab.URL)}
+		}
+		v.Tabs = tabs
+		return v
+	default:
+		return op
+	}
+}
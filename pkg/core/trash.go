@@ -0,0 +1,15 @@
+package core
+
+// IsTrashed reports whether id is the trash folder or lives anywhere beneath it.
+func IsTrashed(tree Tree, id string) bool {
+	for {
+		if id == TrashID {
+			return true
+		}
+		node, ok := tree.Nodes[id]
+		if !ok || node.ParentID == nil {
+			return false
+		}
+		id = *node.ParentID
+	}
+}
@@ -6,18 +6,39 @@ type NodeKind string
 const (
 	KindFolder   NodeKind = "folder"
 	KindBookmark NodeKind = "bookmark"
+	// KindSeparator is a divider line between siblings. Separators have no
+	// title or URL and cannot hold children.
+	KindSeparator NodeKind = "separator"
+	// KindSmart is a folder whose contents are the results of its saved
+	// Query rather than stored children.
+	KindSmart NodeKind = "smart"
 )
 
+// TrashID is the system folder that holds soft-deleted nodes.
+const TrashID = "trash"
+
 // Node represents a folder or bookmark in the tree.
 type Node struct {
-	ID        string   `json:"id"`
-	Kind      NodeKind `json:"kind"`
-	Title     string   `json:"title"`
-	URL       *string  `json:"url,omitempty"`
-	ParentID  *string  `json:"parentId"`
-	Ord       float64  `json:"ord"`
-	CreatedAt int64    `json:"createdAt"`
-	UpdatedAt int64    `json:"updatedAt"`
+	ID           string      `json:"id"`
+	Kind         NodeKind    `json:"kind"`
+	Title        string      `json:"title"`
+	URL          *string     `json:"url,omitempty"`
+	CanonicalURL *string     `json:"canonicalUrl,omitempty"` // derived from URL by storage
+	Notes        string      `json:"notes,omitempty"`
+	Query        *SmartQuery `json:"query,omitempty"`
+	ParentID     *string     `json:"parentId"`
+	Ord          float64     `json:"ord"`
+	Tags         []string    `json:"tags,omitempty"`
+	Trashed      *TrashInfo  `json:"trashed,omitempty"`
+	CreatedAt    int64       `json:"createdAt"`
+	UpdatedAt    int64       `json:"updatedAt"`
+}
+
+// TrashInfo records where a soft-deleted node lived before it was trashed.
+type TrashInfo struct {
+	ParentID  string `json:"parentId"`
+	Index     int    `json:"index"`
+	DeletedAt int64  `json:"deletedAt"`
 }
 
 // Tree contains a snapshot of the bookmark forest.
@@ -33,65 +54,132 @@ type Op interface {
 	isOp()
 }
 
-// AddFolderOp creates a folder under ParentID.
+// AddFolderOp creates a folder under ParentID. TempID optionally names the new
+// node so later ops in the same batch can reference it.
 type AddFolderOp struct {
-	ParentID string
-	Title    string
-	Index    *int
+	ParentID string `json:"parentId"`
+	Title    string `json:"title"`
+	Index    *int   `json:"index,omitempty"`
+	TempID   string `json:"tempId,omitempty"`
 }
 
 func (AddFolderOp) isOp() {}
 
-// AddBookmarkOp creates a bookmark under ParentID.
+// AddBookmarkOp creates a bookmark under ParentID. TempID behaves as for
+// AddFolderOp.
 type AddBookmarkOp struct {
-	ParentID string
-	Title    string
-	URL      string
-	Index    *int
+	ParentID string `json:"parentId"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Index    *int   `json:"index,omitempty"`
+	TempID   string `json:"tempId,omitempty"`
 }
 
 func (AddBookmarkOp) isOp() {}
 
+// AddSeparatorOp inserts a separator under ParentID. TempID behaves as for
+// AddFolderOp.
+type AddSeparatorOp struct {
+	ParentID string `json:"parentId"`
+	Index    *int   `json:"index,omitempty"`
+	TempID   string `json:"tempId,omitempty"`
+}
+
+func (AddSeparatorOp) isOp() {}
+
+// AddSmartFolderOp creates a smart folder under ParentID. TempID behaves as
+// for AddFolderOp.
+type AddSmartFolderOp struct {
+	ParentID string     `json:"parentId"`
+	Title    string     `json:"title"`
+	Query    SmartQuery `json:"query"`
+	Index    *int       `json:"index,omitempty"`
+	TempID   string     `json:"tempId,omitempty"`
+}
+
+func (AddSmartFolderOp) isOp() {}
+
 // RenameNodeOp renames an existing node.
 type RenameNodeOp struct {
-	NodeID string
-	Title  string
+	NodeID string `json:"nodeId"`
+	Title  string `json:"title"`
 }
 
 func (RenameNodeOp) isOp() {}
 
 // MoveNodeOp moves a node to a new parent/index.
 type MoveNodeOp struct {
-	NodeID      string
-	NewParentID string
-	NewIndex    *int
+	NodeID      string `json:"nodeId"`
+	NewParentID string `json:"newParentId"`
+	NewIndex    *int   `json:"newIndex,omitempty"`
 }
 
 func (MoveNodeOp) isOp() {}
 
-// DeleteNodeOp removes a node (optionally recursive for folders).
+// DeleteNodeOp removes a node (optionally recursive for folders). Soft deletes
+// move the node into the trash instead of removing it.
 type DeleteNodeOp struct {
-	NodeID    string
-	Recursive bool
+	NodeID    string `json:"nodeId"`
+	Recursive bool   `json:"recursive,omitempty"`
+	Soft      bool   `json:"soft,omitempty"`
 }
 
 func (DeleteNodeOp) isOp() {}
 
+// RestoreNodeOp moves a trashed node back to its original parent/index, or to
+// ParentID/Index when provided.
+type RestoreNodeOp struct {
+	NodeID   string `json:"nodeId"`
+	ParentID string `json:"parentId,omitempty"`
+	Index    *int   `json:"index,omitempty"`
+}
+
+func (RestoreNodeOp) isOp() {}
+
 // UpdateBookmarkOp updates bookmark metadata.
 type UpdateBookmarkOp struct {
-	NodeID string
-	Title  *string
-	URL    *string
+	NodeID string  `json:"nodeId"`
+	Title  *string `json:"title,omitempty"`
+	URL    *string `json:"url,omitempty"`
+	Notes  *string `json:"notes,omitempty"`
 }
 
 func (UpdateBookmarkOp) isOp() {}
 
-// SaveSessionOp creates a folder with tab captures.
+// UpdateFolderOp updates folder metadata. Query may only be set on smart
+// folders.
+type UpdateFolderOp struct {
+	NodeID string      `json:"nodeId"`
+	Title  *string     `json:"title,omitempty"`
+	Notes  *string     `json:"notes,omitempty"`
+	Query  *SmartQuery `json:"query,omitempty"`
+}
+
+func (UpdateFolderOp) isOp() {}
+
+// AddTagsOp attaches tags to an existing node.
+type AddTagsOp struct {
+	NodeID string   `json:"nodeId"`
+	Tags   []string `json:"tags"`
+}
+
+func (AddTagsOp) isOp() {}
+
+// RemoveTagsOp detaches tags from an existing node.
+type RemoveTagsOp struct {
+	NodeID string   `json:"nodeId"`
+	Tags   []string `json:"tags"`
+}
+
+func (RemoveTagsOp) isOp() {}
+
+// SaveSessionOp creates a folder with tab captures. TempID names the folder.
 type SaveSessionOp struct {
-	ParentID string
-	Title    string
-	Tabs     []Tab
-	Index    *int
+	ParentID string `json:"parentId"`
+	Title    string `json:"title"`
+	Tabs     []Tab  `json:"tabs"`
+	Index    *int   `json:"index,omitempty"`
+	TempID   string `json:"tempId,omitempty"`
 }
 
 func (SaveSessionOp) isOp() {}
@@ -101,3 +189,80 @@ type Tab struct {
 	Title string `json:"title"`
 	URL   string `json:"url"`
 }
+
+// MergeDuplicatesOp keeps one of several bookmarks sharing a canonical URL,
+// chosen by Strategy, and deletes the rest. Tags of the deleted bookmarks are
+// added to the survivor. Soft moves the rest to the trash instead.
+type MergeDuplicatesOp struct {
+	NodeIDs  []string      `json:"nodeIds"`
+	Strategy MergeStrategy `json:"strategy,omitempty"`
+	Soft     bool          `json:"soft,omitempty"`
+}
+
+func (MergeDuplicatesOp) isOp() {}
+
+// CopyNodeOp deep-copies a node and its descendants under NewParentID with
+// fresh IDs, keeping titles, URLs, notes, queries, tags, and child order.
+// TempID names the copy of NodeID.
+type CopyNodeOp struct {
+	NodeID      string `json:"nodeId"`
+	NewParentID string `json:"newParentId"`
+	NewIndex    *int   `json:"newIndex,omitempty"`
+	TempID      string `json:"tempId,omitempty"`
+}
+
+func (CopyNodeOp) isOp() {}
+
+// ReplaceOp finds and replaces text in the titles and/or URLs of NodeID and
+// its descendants. Find is a literal string unless Regex is set; Fields
+// defaults to both title and url. A DryRun op changes nothing, so clients
+// can preview the rewrites with PlanReplace.
+type ReplaceOp struct {
+	NodeID  string         `json:"nodeId"`
+	Find    string         `json:"find"`
+	Replace string         `json:"replace"`
+	Regex   bool           `json:"regex,omitempty"`
+	Fields  []ReplaceField `json:"fields,omitempty"`
+	DryRun  bool           `json:"dryRun,omitempty"`
+}
+
+func (ReplaceOp) isOp() {}
+
+// MergeFoldersOp moves every child of SourceID into TargetID and removes the
+// emptied source. Children are appended after the target's own unless
+// Interleave is set, which merges both lists by ord. Dedupe drops source
+// bookmarks whose canonical URL is already in the target, copying their tags
+// onto the kept one. Soft moves removed nodes to the trash instead of
+// deleting them.
+type MergeFoldersOp struct {
+	SourceID   string `json:"sourceId"`
+	TargetID   string `json:"targetId"`
+	Interleave bool   `json:"interleave,omitempty"`
+	Dedupe     bool   `json:"dedupe,omitempty"`
+	Soft       bool   `json:"soft,omitempty"`
+}
+
+func (MergeFoldersOp) isOp() {}
+
+// SortChildrenOp reorders the children of folder NodeID by a key. KindFirst
+// groups folders before bookmarks before separators; Recursive also sorts
+// every folder below NodeID.
+type SortChildrenOp struct {
+	NodeID     string  `json:"nodeId"`
+	By         SortKey `json:"by"`
+	Descending bool    `json:"descending,omitempty"`
+	KindFirst  bool    `json:"kindFirst,omitempty"`
+	Recursive  bool    `json:"recursive,omitempty"`
+}
+
+func (SortChildrenOp) isOp() {}
+
+// PutNodesOp writes full node records back into the store, creating nodes that
+// are missing and overwriting the parent, ord, metadata, tags, and trash info of
+// those that exist. Parents must precede their children. It is produced by the
+// store as the inverse of other ops and is not accepted from clients.
+type PutNodesOp struct {
+	Nodes []Node `json:"nodes"`
+}
+
+func (PutNodesOp) isOp() {}
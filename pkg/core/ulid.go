@@ -19,3 +19,8 @@ func NewNodeID() string {
 	defer entropyMu.Unlock()
 	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
 }
+
+// NewBatchID generates a ULID string identifying an applied batch.
+func NewBatchID() string {
+	return NewNodeID()
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"net/url"
+	"strings"
+)
+
+// TrailingSlash selects how NormalizeURL treats a trailing slash on a
+// non-root path.
+type TrailingSlash string
+
+const (
+	TrailingSlashStrip TrailingSlash = "strip"
+	TrailingSlashKeep  TrailingSlash = "keep"
+	TrailingSlashAdd   TrailingSlash = "add"
+)
+
+// DefaultTrackingParams lists query parameters dropped by default. A trailing
+// "*" matches any parameter with that prefix.
+var DefaultTrackingParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"igshid",
+	"yclid",
+	"_hsenc",
+	"_hsmi",
+}
+
+// URLRules configures NormalizeURL.
+type URLRules struct {
+	StripDefaultPort    bool
+	StripTrackingParams bool
+	// TrackingParams are matched case-insensitively against parameter names.
+	TrackingParams []string
+	TrailingSlash  TrailingSlash
+}
+
+// DefaultURLRules returns the rules used when a profile configures none.
+func DefaultURLRules() URLRules {
+	return URLRules{
+		StripDefaultPort:    true,
+		StripTrackingParams: true,
+		TrackingParams:      DefaultTrackingParams,
+		TrailingSlash:       TrailingSlashStrip,
+	}
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeURL returns the canonical form of raw under rules, used to match
+// bookmarks that point at the same page. The scheme and host are lowercased,
+// an empty path becomes "/", and the fragment is kept.
+func NormalizeURL(raw string, rules URLRules) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", ErrInvalidURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if rules.StripDefaultPort && port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	switch {
+	case u.Path == "" || u.Path == "/":
+		u.Path, u.RawPath = "/", ""
+	case rules.TrailingSlash == TrailingSlashStrip:
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+		if u.Path == "" {
+			u.Path, u.RawPath = "/", ""
+		}
+	case rules.TrailingSlash == TrailingSlashAdd && !strings.HasSuffix(u.Path, "/"):
+		u.Path += "/"
+		if u.RawPath != "" {
+			u.RawPath += "/"
+		}
+	}
+
+	if rules.StripTrackingParams && u.RawQuery != "" {
+		kept := make([]string, 0)
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			if pair == "" {
+				continue
+			}
+			key, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(key); err == nil && isTrackingParam(name, rules.TrackingParams) {
+				continue
+			}
+			kept = append(kept, pair)
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// URLOrigin returns the scheme and host of raw, such as
+// "https://example.com:8443", lowercased and without a default port. Pages on
+// one origin share a favicon.
+func URLOrigin(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", ErrInvalidURL
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" && port != defaultPorts[scheme] {
+		host += ":" + port
+	}
+	return scheme + "://" + host, nil
+}
+
+func isTrackingParam(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,7 @@ package core
 
 import (
 	"errors"
-	"net/url"
+	"fmt"
 )
 
 var (
@@ -10,7 +10,7 @@ var (
 	ErrInvalidParent = errors.New("invalid parent")
 	// ErrCycleDetected indicates a move that would introduce a cycle.
 	ErrCycleDetected = errors.New("cycle detected")
-	// ErrRootImmutable indicates an operation touched the root node.
+	// ErrRootImmutable indicates an operation touched the root or trash system folders.
 	ErrRootImmutable = errors.New("root immutable")
 	// ErrInvalidNode indicates the referenced node does not exist or is wrong type.
 	ErrInvalidNode = errors.New("invalid node")
@@ -18,100 +18,407 @@ var (
 	ErrInvalidIndex = errors.New("invalid index")
 	// ErrInvalidURL indicates URL validation failure.
 	ErrInvalidURL = errors.New("invalid url")
+	// ErrFolderNotEmpty indicates a non-recursive delete of a folder with children.
+	ErrFolderNotEmpty = errors.New("folder not empty")
+	// ErrInvalidTag indicates an empty or malformed tag list.
+	ErrInvalidTag = errors.New("invalid tag")
+	// ErrInvalidTempID indicates a temp ID reused within a batch, colliding
+	// with an existing node, or starting with "/", which marks a path.
+	ErrInvalidTempID = errors.New("invalid temp id")
+	// ErrNotTrashed indicates a restore of a node that is not directly in the trash.
+	ErrNotTrashed = errors.New("node not in trash")
+	// ErrInvalidQuery indicates a smart folder query with no criteria or bad values.
+	ErrInvalidQuery = errors.New("invalid smart folder query")
+	// ErrCopyTooLarge indicates a copy of more than MaxCopyNodes nodes.
+	ErrCopyTooLarge = errors.New("copy too large")
+	// ErrInvalidReplace indicates a replace with an empty or malformed
+	// pattern or an unknown field.
+	ErrInvalidReplace = errors.New("invalid replace")
+	// ErrInvalidSort indicates a sort with an unknown key.
+	ErrInvalidSort = errors.New("invalid sort key")
+	// ErrInvalidMerge indicates a duplicate merge of fewer than two distinct
+	// bookmarks, bookmarks with different canonical URLs, or an unknown strategy.
+	ErrInvalidMerge = errors.New("invalid duplicate merge")
 )
 
-// ValidateOps performs basic syntactic validation of a batch before hitting storage.
-func ValidateOps(tree Tree, ops []Op) error {
+// ValidationError reports which op in a batch failed validation. Err is the
+// sentinel describing the reason, or an error wrapping one such as
+// *SchemeError; NodeID and ParentID are the IDs the op referenced, when it
+// has them.
+type ValidationError struct {
+	Index    int
+	OpType   string
+	NodeID   string
+	ParentID string
+	Err      error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("op %d (%s): %v", e.Index, e.OpType, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateOps performs basic syntactic validation of a batch before hitting
+// storage, enforcing policy on URLs. Failures are returned as
+// *ValidationError wrapping a sentinel.
+func ValidateOps(tree Tree, ops []Op, policy ValidationPolicy) error {
 	state := newTreeState(tree)
-	for _, op := range ops {
-		switch v := op.(type) {
-		case AddFolderOp:
-			if err := state.requireParentFolder(v.ParentID); err != nil {
-				return err
-			}
-			if err := validateIndex(v.Index, len(state.children[v.ParentID])); err != nil {
-				return err
-			}
-		case AddBookmarkOp:
-			if err := state.requireParentFolder(v.ParentID); err != nil {
-				return err
-			}
-			if err := validateIndex(v.Index, len(state.children[v.ParentID])); err != nil {
-				return err
-			}
-			if err := validateURL(v.URL); err != nil {
-				return err
-			}
-		case RenameNodeOp:
-			node, err := state.requireNode(v.NodeID)
-			if err != nil {
+	state.policy = policy
+	for i, op := range ops {
+		if err := state.validateOp(i, op); err != nil {
+			nodeID, parentID := opRefs(op)
+			return &ValidationError{Index: i, OpType: OpType(op), NodeID: nodeID, ParentID: parentID, Err: err}
+		}
+	}
+	return nil
+}
+
+// validateOp checks op i against the state and applies its effect so later
+// ops in the batch see it.
+func (s *treeState) validateOp(i int, op Op) error {
+	switch v := op.(type) {
+	case AddFolderOp:
+		if err := s.requireParentFolder(v.ParentID); err != nil {
+			return err
+		}
+		if err := validateIndex(v.Index, len(s.children[v.ParentID])); err != nil {
+			return err
+		}
+		if err := s.policy.checkTitle("title", v.Title, textName); err != nil {
+			return err
+		}
+		key := newNodeKey(i, v.TempID)
+		if err := s.addNode(key, KindFolder, v.ParentID); err != nil {
+			return err
+		}
+		s.nodes[key].Title = v.Title
+	case AddBookmarkOp:
+		if err := s.requireParentFolder(v.ParentID); err != nil {
+			return err
+		}
+		if err := validateIndex(v.Index, len(s.children[v.ParentID])); err != nil {
+			return err
+		}
+		if err := s.policy.checkTitle("title", v.Title, textLine); err != nil {
+			return err
+		}
+		if err := s.policy.checkURL("url", v.URL); err != nil {
+			return err
+		}
+		key := newNodeKey(i, v.TempID)
+		if err := s.addNode(key, KindBookmark, v.ParentID); err != nil {
+			return err
+		}
+		url := v.URL
+		s.nodes[key].Title, s.nodes[key].URL = v.Title, &url
+	case AddSeparatorOp:
+		if err := s.requireParentFolder(v.ParentID); err != nil {
+			return err
+		}
+		if err := validateIndex(v.Index, len(s.children[v.ParentID])); err != nil {
+			return err
+		}
+		if err := s.addNode(newNodeKey(i, v.TempID), KindSeparator, v.ParentID); err != nil {
+			return err
+		}
+	case AddSmartFolderOp:
+		if err := s.requireParentFolder(v.ParentID); err != nil {
+			return err
+		}
+		if err := validateIndex(v.Index, len(s.children[v.ParentID])); err != nil {
+			return err
+		}
+		if err := s.policy.checkTitle("title", v.Title, textName); err != nil {
+			return err
+		}
+		if err := s.policy.checkQuery(v.Query); err != nil {
+			return err
+		}
+		key := newNodeKey(i, v.TempID)
+		if err := s.addNode(key, KindSmart, v.ParentID); err != nil {
+			return err
+		}
+		s.nodes[key].Title = v.Title
+	case RenameNodeOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if isSystemNode(node.ID) {
+			return ErrRootImmutable
+		}
+		if node.Kind == KindSeparator {
+			return ErrInvalidNode
+		}
+		kind := textName
+		if node.Kind == KindBookmark {
+			kind = textLine
+		}
+		if err := s.policy.checkTitle("title", v.Title, kind); err != nil {
+			return err
+		}
+		node.Title = v.Title
+	case MoveNodeOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if isSystemNode(node.ID) {
+			return ErrRootImmutable
+		}
+		if err := s.requireParentFolder(v.NewParentID); err != nil {
+			return err
+		}
+		if v.NewParentID == node.ID {
+			return ErrCycleDetected
+		}
+		if s.isDescendant(v.NewParentID, node.ID) {
+			return ErrCycleDetected
+		}
+		if err := validateIndex(v.NewIndex, len(s.children[v.NewParentID])); err != nil {
+			return err
+		}
+		s.moveNode(node.ID, v.NewParentID)
+	case DeleteNodeOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if isSystemNode(node.ID) {
+			return ErrRootImmutable
+		}
+		if !v.Recursive && len(s.children[node.ID]) > 0 {
+			return ErrFolderNotEmpty
+		}
+		s.removeNode(node.ID, v.Soft && !s.isDescendant(node.ID, TrashID))
+	case RestoreNodeOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if node.ParentID == nil || *node.ParentID != TrashID {
+			return ErrNotTrashed
+		}
+		target := v.ParentID
+		if target == "" {
+			target = s.restoreTarget(node)
+		}
+		if err := s.requireParentFolder(target); err != nil {
+			return err
+		}
+		if s.isDescendant(target, TrashID) {
+			return ErrInvalidParent
+		}
+		if err := validateIndex(v.Index, len(s.children[target])); err != nil {
+			return err
+		}
+		s.moveNode(node.ID, target)
+	case UpdateBookmarkOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if node.Kind != KindBookmark {
+			return ErrInvalidNode
+		}
+		if v.Title != nil {
+			if err := s.policy.checkTitle("title", *v.Title, textLine); err != nil {
 				return err
 			}
-			if node.ID == "root" {
-				return ErrRootImmutable
-			}
-		case MoveNodeOp:
-			node, err := state.requireNode(v.NodeID)
-			if err != nil {
+			node.Title = *v.Title
+		}
+		if err := s.policy.checkNotes(v.Notes); err != nil {
+			return err
+		}
+		if v.URL != nil {
+			if err := s.policy.checkURL("url", *v.URL); err != nil {
 				return err
 			}
-			if node.ID == "root" {
-				return ErrRootImmutable
-			}
-			if err := state.requireParentFolder(v.NewParentID); err != nil {
+			// The canonical form is only known once storage applies the
+			// rules, so later merges in the batch cannot rely on it.
+			url := *v.URL
+			node.URL, node.CanonicalURL = &url, nil
+		}
+	case AddTagsOp:
+		if err := s.requireTaggable(v.NodeID); err != nil {
+			return err
+		}
+		if err := validateTags(v.Tags); err != nil {
+			return err
+		}
+		if err := s.policy.checkTags("tags", v.Tags); err != nil {
+			return err
+		}
+	case RemoveTagsOp:
+		// The text rules are not applied here, so tags stored before
+		// they existed can still be removed.
+		if err := s.requireTaggable(v.NodeID); err != nil {
+			return err
+		}
+		if err := validateTags(v.Tags); err != nil {
+			return err
+		}
+	case UpdateFolderOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if isSystemNode(node.ID) {
+			return ErrRootImmutable
+		}
+		if node.Kind != KindFolder && node.Kind != KindSmart {
+			return ErrInvalidNode
+		}
+		if v.Title != nil {
+			if err := s.policy.checkTitle("title", *v.Title, textName); err != nil {
 				return err
 			}
-			if v.NewParentID == node.ID {
-				return ErrCycleDetected
-			}
-			if state.isDescendant(v.NewParentID, node.ID) {
-				return ErrCycleDetected
+			node.Title = *v.Title
+		}
+		if err := s.policy.checkNotes(v.Notes); err != nil {
+			return err
+		}
+		if v.Query != nil {
+			if node.Kind != KindSmart {
+				return ErrInvalidNode
 			}
-			if err := validateIndex(v.NewIndex, len(state.children[v.NewParentID])); err != nil {
+			if err := s.policy.checkQuery(*v.Query); err != nil {
 				return err
 			}
-			state.moveNode(node.ID, v.NewParentID)
-		case DeleteNodeOp:
-			node, err := state.requireNode(v.NodeID)
-			if err != nil {
+		}
+	case SaveSessionOp:
+		if err := s.requireParentFolder(v.ParentID); err != nil {
+			return err
+		}
+		if err := validateIndex(v.Index, len(s.children[v.ParentID])); err != nil {
+			return err
+		}
+		if err := s.policy.checkTitle("title", v.Title, textName); err != nil {
+			return err
+		}
+		for j, tab := range v.Tabs {
+			if err := s.policy.checkTitle(fmt.Sprintf("tabs[%d].title", j), tab.Title, textLine); err != nil {
 				return err
 			}
-			if node.ID == "root" {
-				return ErrRootImmutable
-			}
-			state.deleteNode(node.ID)
-		case UpdateBookmarkOp:
-			node, err := state.requireNode(v.NodeID)
-			if err != nil {
+			if err := s.policy.checkURL(fmt.Sprintf("tabs[%d].url", j), tab.URL); err != nil {
 				return err
 			}
-			if node.Kind != KindBookmark {
-				return ErrInvalidNode
-			}
-			if v.URL != nil {
-				if err := validateURL(*v.URL); err != nil {
-					return err
-				}
-			}
-		case SaveSessionOp:
-			if err := state.requireParentFolder(v.ParentID); err != nil {
+		}
+		folderKey := newNodeKey(i, v.TempID)
+		if err := s.addNode(folderKey, KindFolder, v.ParentID); err != nil {
+			return err
+		}
+		s.nodes[folderKey].Title = v.Title
+		for j, tab := range v.Tabs {
+			key := fmt.Sprintf("#%d.%d", i, j)
+			if err := s.addNode(key, KindBookmark, folderKey); err != nil {
 				return err
 			}
-			if err := validateIndex(v.Index, len(state.children[v.ParentID])); err != nil {
+			url := tab.URL
+			s.nodes[key].Title, s.nodes[key].URL = tab.Title, &url
+		}
+	case CopyNodeOp:
+		if err := s.validateCopy(i, v); err != nil {
+			return err
+		}
+	case ReplaceOp:
+		if err := s.validateReplace(v); err != nil {
+			return err
+		}
+	case MergeFoldersOp:
+		if err := s.validateMergeFolders(v); err != nil {
+			return err
+		}
+	case SortChildrenOp:
+		node, err := s.requireNode(v.NodeID)
+		if err != nil {
+			return err
+		}
+		if node.Kind != KindFolder {
+			return ErrInvalidNode
+		}
+		if !v.By.valid() {
+			return ErrInvalidSort
+		}
+	case MergeDuplicatesOp:
+		if err := s.validateMerge(v); err != nil {
+			return err
+		}
+	case PutNodesOp:
+		for _, node := range v.Nodes {
+			if err := s.putNode(node); err != nil {
 				return err
 			}
-			for _, tab := range v.Tabs {
-				if err := validateURL(tab.URL); err != nil {
-					return err
-				}
-			}
-		default:
-			return errors.New("unsupported op")
 		}
+	default:
+		return errors.New("unsupported op")
 	}
 	return nil
 }
 
+// opRefs returns the node and parent IDs op references.
+func opRefs(op Op) (nodeID, parentID string) {
+	switch v := op.(type) {
+	case AddFolderOp:
+		return "", v.ParentID
+	case AddBookmarkOp:
+		return "", v.ParentID
+	case AddSeparatorOp:
+		return "", v.ParentID
+	case AddSmartFolderOp:
+		return "", v.ParentID
+	case SaveSessionOp:
+		return "", v.ParentID
+	case RenameNodeOp:
+		return v.NodeID, ""
+	case MoveNodeOp:
+		return v.NodeID, v.NewParentID
+	case DeleteNodeOp:
+		return v.NodeID, ""
+	case RestoreNodeOp:
+		return v.NodeID, v.ParentID
+	case UpdateBookmarkOp:
+		return v.NodeID, ""
+	case UpdateFolderOp:
+		return v.NodeID, ""
+	case AddTagsOp:
+		return v.NodeID, ""
+	case RemoveTagsOp:
+		return v.NodeID, ""
+	case CopyNodeOp:
+		return v.NodeID, v.NewParentID
+	case ReplaceOp:
+		return v.NodeID, ""
+	case MergeFoldersOp:
+		return v.SourceID, v.TargetID
+	case SortChildrenOp:
+		return v.NodeID, ""
+	case MergeDuplicatesOp:
+		if len(v.NodeIDs) > 0 {
+			return v.NodeIDs[0], ""
+		}
+		return "", ""
+	default:
+		return "", ""
+	}
+}
+
+// newNodeKey names a node created by op i in the validation state: its temp
+// ID when given, otherwise a placeholder no ULID can collide with.
+func newNodeKey(i int, tempID string) string {
+	if tempID != "" {
+		return tempID
+	}
+	return fmt.Sprintf("#%d", i)
+}
+
+func isSystemNode(id string) bool {
+	return id == "root" || id == TrashID
+}
+
 func validateIndex(idx *int, length int) error {
 	if idx == nil {
 		return nil
@@ -122,23 +429,10 @@ func validateIndex(idx *int, length int) error {
 	return nil
 }
 
-func validateURL(raw string) error {
-	if raw == "" {
-		return ErrInvalidURL
-	}
-	parsed, err := url.Parse(raw)
-	if err != nil {
-		return ErrInvalidURL
-	}
-	if parsed.Scheme != "http" && parsed.Scheme != "https" {
-		return ErrInvalidURL
-	}
-	return nil
-}
-
 type treeState struct {
 	nodes    map[string]*Node
 	children map[string][]string
+	policy   ValidationPolicy
 }
 
 func newTreeState(tree Tree) *treeState {
@@ -159,9 +453,68 @@ func newTreeState(tree Tree) *treeState {
 	return &treeState{nodes: nodes, children: children}
 }
 
+// addNode records a node created earlier in the batch so later ops can
+// reference it.
+func (s *treeState) addNode(id string, kind NodeKind, parentID string) error {
+	if _, exists := s.nodes[id]; exists || IsPath(id) {
+		return ErrInvalidTempID
+	}
+	parent := parentID
+	s.nodes[id] = &Node{ID: id, Kind: kind, ParentID: &parent}
+	s.children[parentID] = append(s.children[parentID], id)
+	return nil
+}
+
+// putNode applies a PutNodesOp record. Unlike regular ops the parent may be
+// the trash or a folder inside it, since records restore trashed nodes too.
+func (s *treeState) putNode(node Node) error {
+	if isSystemNode(node.ID) {
+		return ErrRootImmutable
+	}
+	switch node.Kind {
+	case KindFolder, KindBookmark:
+	case KindSeparator:
+		if node.Title != "" || node.URL != nil {
+			return ErrInvalidNode
+		}
+	case KindSmart:
+		if node.Query == nil {
+			return ErrInvalidQuery
+		}
+	default:
+		return ErrInvalidNode
+	}
+	if node.ParentID == nil {
+		return ErrInvalidParent
+	}
+	parentID := *node.ParentID
+	parent, ok := s.nodes[parentID]
+	if !ok || parent.Kind != KindFolder {
+		return ErrInvalidParent
+	}
+	existing, ok := s.nodes[node.ID]
+	if !ok {
+		if err := s.addNode(node.ID, node.Kind, parentID); err != nil {
+			return err
+		}
+		added := s.nodes[node.ID]
+		added.Title, added.URL, added.Trashed = node.Title, node.URL, node.Trashed
+		return nil
+	}
+	if s.isDescendant(parentID, node.ID) {
+		return ErrCycleDetected
+	}
+	if existing.Kind != node.Kind {
+		return ErrInvalidNode
+	}
+	s.moveNode(node.ID, parentID)
+	existing.Title, existing.URL, existing.Trashed = node.Title, node.URL, node.Trashed
+	return nil
+}
+
 func (s *treeState) requireParentFolder(id string) error {
 	node, ok := s.nodes[id]
-	if !ok {
+	if !ok || id == TrashID {
 		return ErrInvalidParent
 	}
 	if node.Kind != KindFolder {
@@ -178,6 +531,33 @@ func (s *treeState) requireNode(id string) (*Node, error) {
 	return node, nil
 }
 
+// restoreTarget returns the folder a trashed node returns to: its original
+// parent when that folder still exists outside the trash, otherwise root.
+func (s *treeState) restoreTarget(node *Node) string {
+	if node.Trashed == nil {
+		return "root"
+	}
+	parent, ok := s.nodes[node.Trashed.ParentID]
+	if !ok || parent.Kind != KindFolder || s.isDescendant(parent.ID, TrashID) {
+		return "root"
+	}
+	return parent.ID
+}
+
+func (s *treeState) requireTaggable(id string) error {
+	node, err := s.requireNode(id)
+	if err != nil {
+		return err
+	}
+	if isSystemNode(node.ID) {
+		return ErrRootImmutable
+	}
+	if node.Kind == KindSeparator {
+		return ErrInvalidNode
+	}
+	return nil
+}
+
 func (s *treeState) isDescendant(candidate, ancestor string) bool {
 	if candidate == ancestor {
 		return true
@@ -210,11 +590,15 @@ func (s *treeState) moveNode(id, newParent string) {
 	s.children[newParent] = append(s.children[newParent], id)
 }
 
+// deleteNode removes id and all of its descendants.
 func (s *treeState) deleteNode(id string) {
 	node := s.nodes[id]
 	if node == nil {
 		return
 	}
+	for _, child := range append([]string(nil), s.children[id]...) {
+		s.deleteNode(child)
+	}
 	if node.ParentID != nil {
 		parentID := *node.ParentID
 		children := s.children[parentID]
@@ -226,4 +610,5 @@ func (s *treeState) deleteNode(id string) {
 		}
 	}
 	delete(s.nodes, id)
+	delete(s.children, id)
 }
@@ -1,62 +1,716 @@
 package core
 
-import "testing"
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestValidateOps(t *testing.T) {
 	tree := newTestTree()
 
 	t.Run("invalid parent on add", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{AddFolderOp{ParentID: "missing", Title: "X"}})
-		if err != ErrInvalidParent {
+		err := ValidateOps(tree, []Op{AddFolderOp{ParentID: "missing", Title: "X"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
 			t.Fatalf("expected ErrInvalidParent, got %v", err)
 		}
 	})
 
 	t.Run("rename root", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{RenameNodeOp{NodeID: "root", Title: "new"}})
-		if err != ErrRootImmutable {
+		err := ValidateOps(tree, []Op{RenameNodeOp{NodeID: "root", Title: "new"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
 			t.Fatalf("expected ErrRootImmutable, got %v", err)
 		}
 	})
 
 	t.Run("move creates cycle", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{MoveNodeOp{NodeID: "fld", NewParentID: "childFolder"}})
-		if err != ErrCycleDetected {
+		err := ValidateOps(tree, []Op{MoveNodeOp{NodeID: "fld", NewParentID: "childFolder"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrCycleDetected) {
 			t.Fatalf("expected ErrCycleDetected, got %v", err)
 		}
 	})
 
 	t.Run("bookmark URL validation", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{AddBookmarkOp{ParentID: "root", Title: "bad", URL: "ftp://example.com"}})
-		if err != ErrInvalidURL {
+		err := ValidateOps(tree, []Op{AddBookmarkOp{ParentID: "root", Title: "bad", URL: "ftp://example.com"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidURL) {
 			t.Fatalf("expected ErrInvalidURL, got %v", err)
 		}
 	})
 
 	t.Run("update bookmark wrong target", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{UpdateBookmarkOp{NodeID: "fld", Title: strPtr("x")}})
-		if err != ErrInvalidNode {
+		err := ValidateOps(tree, []Op{UpdateBookmarkOp{NodeID: "fld", Title: strPtr("x")}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
 			t.Fatalf("expected ErrInvalidNode, got %v", err)
 		}
 	})
 
 	t.Run("update bookmark success validation", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{UpdateBookmarkOp{NodeID: "bookmark", URL: strPtr("https://valid.example")}})
+		err := ValidateOps(tree, []Op{UpdateBookmarkOp{NodeID: "bookmark", URL: strPtr("https://valid.example")}}, DefaultValidationPolicy())
 		if err != nil {
 			t.Fatalf("expected nil, got %v", err)
 		}
 	})
 
+	t.Run("update folder wrong target", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{UpdateFolderOp{NodeID: "bookmark", Notes: strPtr("why")}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+	})
+
 	t.Run("delete root forbidden", func(t *testing.T) {
-		err := ValidateOps(tree, []Op{DeleteNodeOp{NodeID: "root"}})
-		if err != ErrRootImmutable {
+		err := ValidateOps(tree, []Op{DeleteNodeOp{NodeID: "root"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
+			t.Fatalf("expected ErrRootImmutable, got %v", err)
+		}
+	})
+
+	t.Run("delete non-empty folder requires recursive", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{DeleteNodeOp{NodeID: "fld"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrFolderNotEmpty) {
+			t.Fatalf("expected ErrFolderNotEmpty, got %v", err)
+		}
+	})
+
+	t.Run("recursive delete removes descendants for later ops", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			DeleteNodeOp{NodeID: "fld", Recursive: true},
+			RenameNodeOp{NodeID: "childFolder", Title: "gone"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+	})
+
+	t.Run("soft delete moves into trash", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			DeleteNodeOp{NodeID: "bookmark", Soft: true},
+			RestoreNodeOp{NodeID: "bookmark"},
+		}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	})
+
+	t.Run("restore requires trashed node", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{RestoreNodeOp{NodeID: "bookmark"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrNotTrashed) {
+			t.Fatalf("expected ErrNotTrashed, got %v", err)
+		}
+	})
+
+	t.Run("restore into trashed folder", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			DeleteNodeOp{NodeID: "fld", Recursive: true, Soft: true},
+			DeleteNodeOp{NodeID: "bookmark", Soft: true},
+			RestoreNodeOp{NodeID: "bookmark", ParentID: "childFolder"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+	})
+
+	t.Run("trash is not a regular parent", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{MoveNodeOp{NodeID: "bookmark", NewParentID: TrashID}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+	})
+
+	t.Run("rename trash forbidden", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{RenameNodeOp{NodeID: TrashID, Title: "Bin"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
+			t.Fatalf("expected ErrRootImmutable, got %v", err)
+		}
+	})
+
+	t.Run("temp id referenced later in batch", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddFolderOp{ParentID: "root", Title: "New", TempID: "tmp-1"},
+			AddBookmarkOp{ParentID: "tmp-1", Title: "Inside", URL: "https://inside.example", TempID: "tmp-2"},
+			AddTagsOp{NodeID: "tmp-2", Tags: []string{"fresh"}},
+		}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	})
+
+	t.Run("temp id collides with existing node", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{AddFolderOp{ParentID: "root", Title: "Dup", TempID: "fld"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidTempID) {
+			t.Fatalf("expected ErrInvalidTempID, got %v", err)
+		}
+	})
+
+	t.Run("temp id reserved for paths", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{AddFolderOp{ParentID: "root", Title: "New", TempID: "/New"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidTempID) {
+			t.Fatalf("expected ErrInvalidTempID, got %v", err)
+		}
+	})
+
+	t.Run("bookmark temp id is not a parent", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddBookmarkOp{ParentID: "root", Title: "Leaf", URL: "https://leaf.example", TempID: "leaf"},
+			AddFolderOp{ParentID: "leaf", Title: "Nested"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+	})
+
+	t.Run("separator cannot be a parent", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddSeparatorOp{ParentID: "root", TempID: "sep"},
+			AddBookmarkOp{ParentID: "sep", Title: "Inside", URL: "https://inside.example"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+	})
+
+	t.Run("separator cannot be renamed", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddSeparatorOp{ParentID: "fld", Index: intPtr(0), TempID: "sep"},
+			RenameNodeOp{NodeID: "sep", Title: "Named"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+	})
+
+	t.Run("smart folder cannot be a parent", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddSmartFolderOp{ParentID: "root", Title: "Recent", Query: SmartQuery{AddedWithinDays: 30}, TempID: "smart"},
+			MoveNodeOp{NodeID: "bookmark", NewParentID: "smart"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+	})
+
+	t.Run("smart folder requires query", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{AddSmartFolderOp{ParentID: "root", Title: "Everything"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Fatalf("expected ErrInvalidQuery, got %v", err)
+		}
+	})
+
+	t.Run("query update on plain folder", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{UpdateFolderOp{NodeID: "fld", Query: &SmartQuery{Text: "x"}}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+	})
+
+	t.Run("sort requires folder and key", func(t *testing.T) {
+		if err := ValidateOps(tree, []Op{SortChildrenOp{NodeID: "bookmark", By: SortByTitle}}, DefaultValidationPolicy()); !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+		if err := ValidateOps(tree, []Op{SortChildrenOp{NodeID: "fld", By: "size"}}, DefaultValidationPolicy()); !errors.Is(err, ErrInvalidSort) {
+			t.Fatalf("expected ErrInvalidSort, got %v", err)
+		}
+	})
+
+	t.Run("copy into own subtree", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			CopyNodeOp{NodeID: "fld", NewParentID: "childFolder", TempID: "tmp_copy"},
+			MoveNodeOp{NodeID: "bookmark", NewParentID: "tmp_copy"},
+		}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{CopyNodeOp{NodeID: "fld", NewParentID: "bookmark"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("expected ErrInvalidParent, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{CopyNodeOp{NodeID: "root", NewParentID: "fld"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
 			t.Fatalf("expected ErrRootImmutable, got %v", err)
 		}
 	})
+
+	t.Run("merge folders", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			MergeFoldersOp{SourceID: "childFolder", TargetID: "root"},
+			MoveNodeOp{NodeID: "childFolder", NewParentID: "root"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected merged source to be gone, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{MergeFoldersOp{SourceID: "fld", TargetID: "childFolder"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrCycleDetected) {
+			t.Fatalf("expected ErrCycleDetected, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{MergeFoldersOp{SourceID: "fld", TargetID: "fld"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrCycleDetected) {
+			t.Fatalf("expected ErrCycleDetected merging into itself, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{MergeFoldersOp{SourceID: "root", TargetID: "fld"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
+			t.Fatalf("expected ErrRootImmutable, got %v", err)
+		}
+		err = ValidateOps(tree, []Op{
+			AddBookmarkOp{ParentID: "fld", Title: "Dup", URL: "https://dup.example", TempID: "a"},
+			AddBookmarkOp{ParentID: "childFolder", Title: "Dup", URL: "https://dup.example", TempID: "b"},
+			MergeFoldersOp{SourceID: "childFolder", TargetID: "fld", Dedupe: true},
+			RenameNodeOp{NodeID: "b", Title: "Gone"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected deduped bookmark to be gone, got %v", err)
+		}
+	})
+
+	t.Run("add tags success validation", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{AddTagsOp{NodeID: "bookmark", Tags: []string{"k8s", " Infra "}}}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	})
+
+	t.Run("add tags empty list", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{AddTagsOp{NodeID: "bookmark", Tags: []string{" "}}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidTag) {
+			t.Fatalf("expected ErrInvalidTag, got %v", err)
+		}
+	})
+
+	t.Run("put nodes recreates subtree", func(t *testing.T) {
+		parent := "root"
+		child := "gone"
+		err := ValidateOps(tree, []Op{
+			PutNodesOp{Nodes: []Node{
+				{ID: "gone", Kind: KindFolder, Title: "Gone", ParentID: &parent},
+				{ID: "leaf", Kind: KindBookmark, Title: "Leaf", URL: strPtr("https://leaf.example"), ParentID: &child},
+			}},
+			MoveNodeOp{NodeID: "bookmark", NewParentID: "gone"},
+		}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	})
+
+	t.Run("put nodes into own subtree", func(t *testing.T) {
+		parent := "childFolder"
+		err := ValidateOps(tree, []Op{PutNodesOp{Nodes: []Node{{ID: "fld", Kind: KindFolder, ParentID: &parent}}}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrCycleDetected) {
+			t.Fatalf("expected ErrCycleDetected, got %v", err)
+		}
+	})
+
+	t.Run("remove tags on root", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{RemoveTagsOp{NodeID: "root", Tags: []string{"x"}}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrRootImmutable) {
+			t.Fatalf("expected ErrRootImmutable, got %v", err)
+		}
+	})
+}
+
+func TestValidationErrorDetails(t *testing.T) {
+	err := ValidateOps(newTestTree(), []Op{
+		RenameNodeOp{NodeID: "bookmark", Title: "ok"},
+		MoveNodeOp{NodeID: "bookmark", NewParentID: "missing"},
+	}, DefaultValidationPolicy())
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected *ValidationError, got %T", err)
+	}
+	if verr.Index != 1 || verr.OpType != "move_node" || verr.NodeID != "bookmark" || verr.ParentID != "missing" {
+		t.Fatalf("unexpected details %+v", verr)
+	}
+	if !errors.Is(err, ErrInvalidParent) {
+		t.Fatalf("expected wrapped ErrInvalidParent, got %v", verr.Err)
+	}
+}
+
+func TestValidationPolicySchemes(t *testing.T) {
+	tree := newTestTree()
+	add := func(url string) Op {
+		return AddBookmarkOp{ParentID: "root", Title: "x", URL: url}
+	}
+
+	err := ValidateOps(tree, []Op{add("javascript:alert('%zz')")}, DefaultValidationPolicy())
+	var serr *SchemeError
+	if !errors.As(err, &serr) || serr.Scheme != "javascript" || len(serr.Allowed) != 2 {
+		t.Fatalf("expected SchemeError listing allowed schemes, got %v", err)
+	}
+	if !errors.Is(err, ErrSchemeNotAllowed) || !errors.Is(err, ErrInvalidURL) {
+		t.Fatalf("expected error to wrap ErrSchemeNotAllowed and ErrInvalidURL, got %v", err)
+	}
+
+	policy := ValidationPolicy{AllowedSchemes: []string{"https", "javascript", "file", "chrome"}}
+	for _, url := range []string{"javascript:alert('%zz')", "file:///home/me/doc.pdf", "chrome://settings", "HTTPS://example.com"} {
+		if err := ValidateOps(tree, []Op{add(url)}, policy); err != nil {
+			t.Fatalf("expected %q allowed, got %v", url, err)
+		}
+	}
+	for _, url := range []string{"javascript:", "file:relative/doc.pdf", "https:///no-host", "chrome:", "no-scheme"} {
+		if err := ValidateOps(tree, []Op{add(url)}, policy); !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("expected %q rejected, got %v", url, err)
+		}
+	}
+}
+
+func TestValidationPolicyText(t *testing.T) {
+	tree := newTestTree()
+	policy := DefaultValidationPolicy()
+	policy.MaxTitleLength = 8
+	policy.MaxTagLength = 8
+
+	cases := []struct {
+		name  string
+		op    Op
+		want  error
+		field string
+	}{
+		{"empty folder title", AddFolderOp{ParentID: "root", Title: "  "}, ErrInvalidText, "title"},
+		{"rename folder to empty", RenameNodeOp{NodeID: "fld", Title: ""}, ErrInvalidText, "title"},
+		{"newline in title", AddBookmarkOp{ParentID: "root", Title: "a\nb", URL: "https://example.com"}, ErrInvalidText, "title"},
+		{"title too long", AddBookmarkOp{ParentID: "root", Title: "ninechars", URL: "https://example.com"}, ErrTextTooLong, "title"},
+		{"decomposed title", RenameNodeOp{NodeID: "bookmark", Title: "Cafe\u0301"}, ErrInvalidText, "title"},
+		{"control char in notes", UpdateBookmarkOp{NodeID: "bookmark", Notes: strPtr("bell\a")}, ErrInvalidText, "notes"},
+		{"session tab title", SaveSessionOp{ParentID: "root", Title: "Tabs", Tabs: []Tab{
+			{Title: "ok", URL: "https://a.example"},
+			{Title: "tab\tbed", URL: "https://b.example"},
+		}}, ErrInvalidText, "tabs[1].title"},
+		{"carriage return in tag", AddTagsOp{NodeID: "bookmark", Tags: []string{"a\rb"}}, ErrInvalidText, "tags"},
+		{"nul in tag", AddTagsOp{NodeID: "bookmark", Tags: []string{"ok", "a\x00b"}}, ErrInvalidText, "tags"},
+		{"decomposed tag", AddTagsOp{NodeID: "bookmark", Tags: []string{"cafe\u0301"}}, ErrInvalidText, "tags"},
+		{"tag too long", AddTagsOp{NodeID: "bookmark", Tags: []string{"ninechars"}}, ErrTextTooLong, "tags"},
+		{"control char in query tag", AddSmartFolderOp{ParentID: "root", Title: "Smart", Query: SmartQuery{Tags: []string{"a\x01"}}}, ErrInvalidText, "query.tags"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateOps(tree, []Op{tc.op}, policy)
+			var ferr *FieldError
+			if !errors.Is(err, tc.want) || !errors.As(err, &ferr) || ferr.Field != tc.field {
+				t.Fatalf("expected %v on %s, got %v", tc.want, tc.field, err)
+			}
+		})
+	}
+
+	t.Run("empty bookmark title and multiline notes", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			AddBookmarkOp{ParentID: "root", Title: "", URL: "https://example.com"},
+			UpdateBookmarkOp{NodeID: "bookmark", Notes: strPtr("line one\n\tline two")},
+		}, policy)
+		if err != nil {
+			t.Fatalf("expected valid, got %v", err)
+		}
+	})
+
+	t.Run("normalize ops produces NFC", func(t *testing.T) {
+		ops := NormalizeOps([]Op{
+			RenameNodeOp{NodeID: "bookmark", Title: "Cafe\u0301"},
+			AddTagsOp{NodeID: "bookmark", Tags: []string{"cafe\u0301"}},
+		})
+		if got := ops[0].(RenameNodeOp).Title; got != "Caf\u00e9" {
+			t.Fatalf("expected NFC title, got %q", got)
+		}
+		if got := ops[1].(AddTagsOp).Tags[0]; got != "caf\u00e9" {
+			t.Fatalf("expected NFC tag, got %q", got)
+		}
+		if err := ValidateOps(tree, ops, policy); err != nil {
+			t.Fatalf("expected normalized op valid, got %v", err)
+		}
+	})
+}
+
+func TestResolveSmartFolder(t *testing.T) {
+	now := time.UnixMilli(100 * 24 * time.Hour.Milliseconds())
+	tree := newTestTree()
+	day := 24 * time.Hour.Milliseconds()
+	add := func(id, title string, createdAt int64, tags ...string) {
+		parent := "root"
+		tree.Nodes[id] = Node{ID: id, Kind: KindBookmark, Title: title, URL: strPtr("https://" + id + ".example"), ParentID: &parent, CreatedAt: createdAt, Tags: tags}
+	}
+	add("old", "Old k8s", now.UnixMilli()-40*day, "k8s")
+	add("new", "New k8s", now.UnixMilli()-2*day, "k8s")
+	add("newer", "Newer k8s", now.UnixMilli()-day, "infra", "k8s")
+	add("untagged", "Untagged", now.UnixMilli()-day)
+	parent := "root"
+	tree.Nodes["smart"] = Node{ID: "smart", Kind: KindSmart, Title: "Recent k8s", ParentID: &parent,
+		Query: &SmartQuery{Tags: []string{"k8s"}, AddedWithinDays: 30}}
+
+	got, err := ResolveSmartFolder(tree, "smart", now)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []string{"newer", "new"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if _, err := ResolveSmartFolder(tree, "fld", now); !errors.Is(err, ErrInvalidNode) {
+		t.Fatalf("expected ErrInvalidNode for plain folder, got %v", err)
+	}
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	tree := newTestTree()
+	canonical := "https://example.com/"
+	add := func(id, parent string, createdAt int64) {
+		p := parent
+		tree.Nodes[id] = Node{ID: id, Kind: KindBookmark, Title: id, URL: strPtr(canonical), CanonicalURL: strPtr(canonical), ParentID: &p, CreatedAt: createdAt}
+	}
+	add("dupRoot", "root", 3)
+	add("dupDeep", "childFolder", 2)
+	add("dupOld", "fld", 1)
+
+	t.Run("merge duplicates", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			MergeDuplicatesOp{NodeIDs: []string{"dupRoot", "dupDeep", "dupOld"}, Strategy: MergeDeepest},
+			RenameNodeOp{NodeID: "dupDeep", Title: "kept"},
+		}, DefaultValidationPolicy())
+		if err != nil {
+			t.Fatalf("expected merge to validate, got %v", err)
+		}
+	})
+
+	t.Run("merged bookmarks are gone", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{
+			MergeDuplicatesOp{NodeIDs: []string{"dupRoot", "dupDeep"}},
+			RenameNodeOp{NodeID: "dupRoot", Title: "gone"},
+		}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidNode) {
+			t.Fatalf("expected ErrInvalidNode, got %v", err)
+		}
+	})
+
+	t.Run("different urls", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{MergeDuplicatesOp{NodeIDs: []string{"dupRoot", "bookmark"}}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidMerge) {
+			t.Fatalf("expected ErrInvalidMerge, got %v", err)
+		}
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+		err := ValidateOps(tree, []Op{MergeDuplicatesOp{NodeIDs: []string{"dupRoot", "dupOld"}, Strategy: "random"}}, DefaultValidationPolicy())
+		if !errors.Is(err, ErrInvalidMerge) {
+			t.Fatalf("expected ErrInvalidMerge, got %v", err)
+		}
+	})
+
+	candidates := []MergeCandidate{
+		{ID: "a", CreatedAt: 3, Depth: 1},
+		{ID: "b", CreatedAt: 2, Depth: 3},
+		{ID: "c", CreatedAt: 1, Depth: 2},
+	}
+	for strategy, want := range map[MergeStrategy]string{"": "c", MergeOldest: "c", MergeNewest: "a", MergeDeepest: "b"} {
+		if got := PickSurvivor(candidates, strategy); got != want {
+			t.Fatalf("PickSurvivor(%q) = %s, want %s", strategy, got, want)
+		}
+	}
+}
+
+func TestSortNodes(t *testing.T) {
+	nodes := []Node{
+		{ID: "b", Kind: KindBookmark, Title: "beta", CreatedAt: 1},
+		{ID: "f", Kind: KindFolder, Title: "Zeta", CreatedAt: 3},
+		{ID: "a", Kind: KindBookmark, Title: "Alpha", CreatedAt: 2},
+		{ID: "a2", Kind: KindBookmark, Title: "alpha", CreatedAt: 4},
+	}
+	ids := func() string {
+		out := ""
+		for _, n := range nodes {
+			out += n.ID + " "
+		}
+		return out
+	}
+	SortNodes(nodes, SortChildrenOp{By: SortByTitle})
+	if got := ids(); got != "a a2 b f " {
+		t.Fatalf("title sort: got %s", got)
+	}
+	SortNodes(nodes, SortChildrenOp{By: SortByTitle, KindFirst: true})
+	if got := ids(); got != "f a a2 b " {
+		t.Fatalf("kind-first sort: got %s", got)
+	}
+	SortNodes(nodes, SortChildrenOp{By: SortByCreated, Descending: true})
+	if got := ids(); got != "a2 f a b " {
+		t.Fatalf("created desc sort: got %s", got)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tree := newTestTree()
+	tree.Children = map[string][]string{"root": {"fld", "bookmark", TrashID}, "fld": {"childFolder"}}
+	policy := DefaultValidationPolicy()
+
+	plan, err := PlanReplace(tree, ReplaceOp{NodeID: "root", Find: `^https://(\w+)\.com$`, Replace: "https://$1.org", Regex: true})
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan) != 1 || plan[0].NodeID != "bookmark" || plan[0].Field != ReplaceURL || plan[0].New != "https://example.org" {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	plan, err = PlanReplace(tree, ReplaceOp{NodeID: "fld", Find: "Folder", Replace: "Dir", Fields: []ReplaceField{ReplaceTitle}})
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan) != 2 || plan[0].New != "Dir" || plan[1].New != "ChildDir" {
+		t.Fatalf("expected scoped title rewrites, got %+v", plan)
+	}
+
+	if err := ValidateOps(tree, []Op{ReplaceOp{NodeID: "root", Find: "https:", Replace: "ftp:", Fields: []ReplaceField{ReplaceURL}}}, policy); !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Fatalf("expected ErrSchemeNotAllowed, got %v", err)
+	}
+	var ferr *FieldError
+	if err := ValidateOps(tree, []Op{ReplaceOp{NodeID: "root", Find: "example.com", Replace: ""}}, policy); !errors.As(err, &ferr) || ferr.Field != "nodes[bookmark].url" {
+		t.Fatalf("expected url field error for bookmark, got %v", err)
+	}
+	if err := ValidateOps(tree, []Op{ReplaceOp{NodeID: "root", Find: "(", Regex: true}}, policy); !errors.Is(err, ErrInvalidReplace) {
+		t.Fatalf("expected ErrInvalidReplace, got %v", err)
+	}
+	// Rewrites see bookmarks added earlier in the batch.
+	err = ValidateOps(tree, []Op{
+		AddBookmarkOp{ParentID: "fld", Title: "New", URL: "https://new.example"},
+		ReplaceOp{NodeID: "fld", Find: "https://", Replace: "gopher://"},
+	}, policy)
+	if !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Fatalf("expected ErrSchemeNotAllowed for new bookmark, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := newTestTree()
+	if ops := Diff(old, old); len(ops) != 0 {
+		t.Fatalf("expected no ops for identical trees, got %+v", ops)
+	}
+
+	next := newTestTree()
+	root := "root"
+	bookmark := next.Nodes["bookmark"]
+	bookmark.ParentID = strPtr("childFolder")
+	bookmark.URL = strPtr("https://example.org")
+	next.Nodes["bookmark"] = bookmark
+	fld := next.Nodes["fld"]
+	fld.Title = "Renamed"
+	next.Nodes["fld"] = fld
+	delete(next.Nodes, "childFolder")
+	next.Nodes["newFolder"] = Node{ID: "newFolder", Kind: KindFolder, Title: "New", ParentID: &root, Ord: 5}
+	bookmark.ParentID = strPtr("newFolder")
+	next.Nodes["bookmark"] = bookmark
+
+	ops := Diff(old, next)
+	var types []string
+	for _, op := range ops {
+		types = append(types, OpType(op))
+	}
+	want := []string{"rename_node", "add_folder", "move_node", "update_bookmark", "delete_node"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected %v, got %v", want, types)
+	}
+	if err := ValidateOps(old, ops, DefaultValidationPolicy()); err != nil {
+		t.Fatalf("diff ops do not validate: %v", err)
+	}
+	if move := ops[2].(MoveNodeOp); move.NewParentID != "newFolder" || *move.NewIndex != 0 {
+		t.Fatalf("unexpected move %+v", move)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tree := newTestTree()
+	fld := "fld"
+	tree.Nodes["slash"] = Node{ID: "slash", Kind: KindFolder, Title: `CI/CD \ ops`, ParentID: &fld}
+	tree.Nodes["dupA"] = Node{ID: "dupA", Kind: KindBookmark, Title: "Dup", ParentID: &fld}
+	tree.Nodes["dupB"] = Node{ID: "dupB", Kind: KindBookmark, Title: "Dup", ParentID: &fld}
+
+	cases := map[string]string{
+		"/":                     "root",
+		"/Folder/ChildFolder":   "childFolder",
+		"/Folder/ChildFolder/":  "childFolder",
+		`/Folder/CI\/CD \\ ops`: "slash",
+	}
+	for path, want := range cases {
+		got, err := ResolvePath(tree, path)
+		if err != nil || got != want {
+			t.Fatalf("%s: expected %s, got %s (%v)", path, want, got, err)
+		}
+	}
+	if got := NodePath(tree, "slash"); got != `/Folder/CI\/CD \\ ops` {
+		t.Fatalf("unexpected node path %s", got)
+	}
+	if crumbs := Breadcrumbs(tree, "childFolder"); len(crumbs) != 1 || crumbs[0].ID != "fld" {
+		t.Fatalf("unexpected breadcrumbs %+v", crumbs)
+	}
+
+	var perr *PathError
+	if _, err := ResolvePath(tree, "/Folder/Dup"); !errors.As(err, &perr) || !errors.Is(err, ErrAmbiguousPath) || len(perr.Matches) != 2 {
+		t.Fatalf("expected ambiguous path with both matches, got %v", err)
+	}
+	if _, err := ResolvePath(tree, "/Folder/Missing"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+	for _, path := range []string{"Folder", "//Folder", `/Folder\x`} {
+		if _, err := ResolvePath(tree, path); !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("%s: expected ErrInvalidPath, got %v", path, err)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got := NormalizeTags([]string{"Work", " k8s", "work", ""})
+	want := []string{"k8s", "work"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	rules := DefaultURLRules()
+	cases := []struct {
+		in, want string
+	}{
+		{"https://Example.com/a/", "https://example.com/a"},
+		{"https://example.com/a", "https://example.com/a"},
+		{"https://example.com/a?utm_source=x&id=3&fbclid=y", "https://example.com/a?id=3"},
+		{"HTTP://example.com:80", "http://example.com/"},
+		{"https://example.com:8443/a/#top", "https://example.com:8443/a#top"},
+	}
+	for _, tc := range cases {
+		got, err := NormalizeURL(tc.in, rules)
+		if err != nil || got != tc.want {
+			t.Fatalf("NormalizeURL(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	rules.TrailingSlash = TrailingSlashKeep
+	rules.StripTrackingParams = false
+	got, err := NormalizeURL("https://example.com/a/?utm_source=x", rules)
+	if err != nil || got != "https://example.com/a/?utm_source=x" {
+		t.Fatalf("expected slash and params kept, got %q, %v", got, err)
+	}
+	if _, err := NormalizeURL("not a url", rules); !errors.Is(err, ErrInvalidURL) {
+		t.Fatalf("expected ErrInvalidURL, got %v", err)
+	}
+}
+
+func TestFrecency(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	if got := Frecency(0, now.UnixMilli(), now); got != 0 {
+		t.Fatalf("expected unvisited bookmark to score 0, got %v", got)
+	}
+	if got := Frecency(4, now.UnixMilli(), now); got != 4 {
+		t.Fatalf("expected a fresh visit count to score in full, got %v", got)
+	}
+	if got := Frecency(4, now.Add(-FrecencyHalfLife).UnixMilli(), now); got != 2 {
+		t.Fatalf("expected one half-life to halve the score, got %v", got)
+	}
+	steady := Frecency(3, now.Add(-24*time.Hour).UnixMilli(), now)
+	stale := Frecency(20, now.Add(-6*FrecencyHalfLife).UnixMilli(), now)
+	if steady <= stale {
+		t.Fatalf("expected recent use to outrank old heavy use, got %v <= %v", steady, stale)
+	}
 }
 
 func newTestTree() Tree {
 	root := Node{ID: "root", Kind: KindFolder, Title: "Root"}
+	trash := Node{ID: TrashID, Kind: KindFolder, Title: "Trash"}
 	fldParent := "root"
 	fld := Node{ID: "fld", Kind: KindFolder, Title: "Folder", ParentID: &fldParent}
 	childParent := "fld"
@@ -68,6 +722,7 @@ func newTestTree() Tree {
 		RootID:  "root",
 		Nodes: map[string]Node{
 			"root":        root,
+			TrashID:       trash,
 			"fld":         fld,
 			"childFolder": childFolder,
 			"bookmark":    bookmark,
@@ -78,3 +733,7 @@ func newTestTree() Tree {
 func strPtr(s string) *string {
 	return &s
 }
+
+func intPtr(i int) *int {
+	return &i
+}
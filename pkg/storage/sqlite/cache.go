@@ -0,0 +1,246 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// CacheStore owns the profile's cache database, which holds data derived
+// from browsing rather than edited by the user: favicons and visits. It is
+// kept apart from the state database so none of it reaches snapshot.json or
+// git history, and it can be deleted at any time.
+type CacheStore struct {
+	db   *sql.DB
+	path string
+}
+
+// OpenCache opens the cache database at path.
+func OpenCache(path string) (*CacheStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheStore{db: db, path: path}, nil
+}
+
+// Path returns the underlying SQLite file path.
+func (c *CacheStore) Path() string {
+	return c.path
+}
+
+// Close releases database resources.
+func (c *CacheStore) Close() error {
+	if c == nil || c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// Init configures pragmas and creates the cache tables. Losing cached data
+// is harmless, so writes are not synced as strictly as the state database.
+func (c *CacheStore) Init(ctx context.Context) error {
+	if c == nil || c.db == nil {
+		return errors.New("nil cache store")
+	}
+	stmts := []string{
+		"PRAGMA journal_mode = WAL;",
+		"PRAGMA synchronous = NORMAL;",
+		"PRAGMA busy_timeout = 5000;",
+		`CREATE TABLE IF NOT EXISTS favicons (
+			origin TEXT PRIMARY KEY,
+			content_type TEXT NOT NULL,
+			data BLOB NOT NULL,
+			fetched_at INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS visits (
+			node_id TEXT PRIMARY KEY,
+			visit_count INTEGER NOT NULL,
+			last_visit_at INTEGER NOT NULL
+		);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := c.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("init cache %q: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// MaxFaviconSize is the largest favicon image PutFavicon accepts, in bytes.
+const MaxFaviconSize = 256 << 10
+
+// ErrInvalidFavicon indicates a favicon with no data, a content type that is
+// not an image, or data larger than MaxFaviconSize.
+var ErrInvalidFavicon = errors.New("invalid favicon")
+
+// Favicon is the icon shared by the pages of one origin.
+type Favicon struct {
+	Origin      string `json:"origin"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+	// FetchedAt is when the client fetched the icon, in Unix milliseconds.
+	FetchedAt int64 `json:"fetchedAt"`
+}
+
+// PutFavicon stores icon, replacing any icon already stored for its origin.
+// The origin is normalized with core.URLOrigin, so a page URL may be given.
+func (c *CacheStore) PutFavicon(ctx context.Context, icon Favicon) (Favicon, error) {
+	origin, err := core.URLOrigin(icon.Origin)
+	if err != nil {
+		return Favicon{}, err
+	}
+	icon.Origin = origin
+	if len(icon.Data) == 0 || len(icon.Data) > MaxFaviconSize || !strings.HasPrefix(icon.ContentType, "image/") {
+		return Favicon{}, ErrInvalidFavicon
+	}
+	_, err = c.db.ExecContext(ctx, `
+		INSERT INTO favicons(origin, content_type, data, fetched_at) VALUES(?,?,?,?)
+		ON CONFLICT(origin) DO UPDATE SET
+			content_type = excluded.content_type,
+			data = excluded.data,
+			fetched_at = excluded.fetched_at`,
+		icon.Origin, icon.ContentType, icon.Data, icon.FetchedAt)
+	if err != nil {
+		return Favicon{}, err
+	}
+	return icon, nil
+}
+
+// Favicons returns the stored icons for the given origins, keyed by origin.
+// Origins without an icon are omitted.
+func (c *CacheStore) Favicons(ctx context.Context, origins []string) (map[string]Favicon, error) {
+	out := make(map[string]Favicon, len(origins))
+	if len(origins) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(origins))
+	for i, origin := range origins {
+		args[i] = origin
+	}
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT origin, content_type, data, fetched_at FROM favicons
+		WHERE origin IN (?`+strings.Repeat(",?", len(origins)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var icon Favicon
+		if err := rows.Scan(&icon.Origin, &icon.ContentType, &icon.Data, &icon.FetchedAt); err != nil {
+			return nil, err
+		}
+		out[icon.Origin] = icon
+	}
+	return out, rows.Err()
+}
+
+// Visit summarizes how often a bookmark has been opened.
+type Visit struct {
+	Count int `json:"count"`
+	// LastVisitAt is the latest visit, in Unix milliseconds.
+	LastVisitAt int64 `json:"lastVisitAt"`
+}
+
+// RecordVisit counts one visit at visitedAt, in Unix milliseconds, for each
+// of nodeIDs. Visits may arrive out of order, so the latest one is kept.
+func (c *CacheStore) RecordVisit(ctx context.Context, nodeIDs []string, visitedAt int64) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range nodeIDs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO visits(node_id, visit_count, last_visit_at) VALUES(?, 1, ?)
+			ON CONFLICT(node_id) DO UPDATE SET
+				visit_count = visit_count + 1,
+				last_visit_at = MAX(last_visit_at, excluded.last_visit_at)`, id, visitedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// visitBatch bounds how many node IDs one visits query binds.
+const visitBatch = 500
+
+// Visits returns the visits recorded for nodeIDs, keyed by node ID. Nodes
+// never visited are omitted.
+func (c *CacheStore) Visits(ctx context.Context, nodeIDs []string) (map[string]Visit, error) {
+	out := make(map[string]Visit)
+	for start := 0; start < len(nodeIDs); start += visitBatch {
+		batch := nodeIDs[start:min(start+visitBatch, len(nodeIDs))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		rows, err := c.db.QueryContext(ctx, `
+			SELECT node_id, visit_count, last_visit_at FROM visits
+			WHERE node_id IN (?`+strings.Repeat(",?", len(batch)-1)+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				id    string
+				visit Visit
+			)
+			if err := rows.Scan(&id, &visit.Count, &visit.LastVisitAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[id] = visit
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// PruneVisits deletes the visits of nodes for which exists reports false,
+// such as bookmarks deleted or purged from the trash, and returns how many
+// it removed.
+func (c *CacheStore) PruneVisits(ctx context.Context, exists func(id string) bool) (int, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT node_id FROM visits`)
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !exists(id) {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, id := range stale {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM visits WHERE node_id = ?`, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), tx.Commit()
+}
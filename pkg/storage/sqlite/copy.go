@@ -0,0 +1,78 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// applyCopyNode copies op.NodeID and its descendants under op.NewParentID
+// with fresh IDs and returns the ID of the copied root. The subtree is read
+// in full before anything is inserted, so copying a folder into one of its
+// own descendants copies it exactly once.
+func (s *Store) applyCopyNode(ctx context.Context, tx *sql.Tx, op core.CopyNodeOp) (string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		WITH RECURSIVE sub(id, parent_id, depth) AS (
+			SELECT id, parent_id, 0 FROM nodes WHERE id = ?
+			UNION ALL
+			SELECT n.id, n.parent_id, sub.depth + 1 FROM nodes n JOIN sub ON n.parent_id = sub.id
+		)
+		SELECT id, parent_id FROM sub ORDER BY depth, id`, op.NodeID)
+	if err != nil {
+		return "", err
+	}
+	type entry struct{ id, parentID string }
+	var subtree []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.parentID); err != nil {
+			rows.Close()
+			return "", err
+		}
+		subtree = append(subtree, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if len(subtree) == 0 {
+		return "", core.ErrInvalidNode
+	}
+
+	rootOrd, err := s.calcOrd(ctx, tx, op.NewParentID, op.NewIndex)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UnixMilli()
+	insert, err := tx.PrepareContext(ctx, `
+		INSERT INTO nodes(id, parent_id, kind, title, url, canonical_url, notes, query, ord, created_at, updated_at)
+		SELECT ?, ?, kind, title, url, canonical_url, notes, query, COALESCE(?, ord), ?, ? FROM nodes WHERE id = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer insert.Close()
+	tags, err := tx.PrepareContext(ctx, `INSERT INTO node_tags(node_id, tag) SELECT ?, tag FROM node_tags WHERE node_id = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer tags.Close()
+
+	newIDs := make(map[string]string, len(subtree))
+	for i, e := range subtree {
+		newID := core.NewNodeID()
+		newIDs[e.id] = newID
+		parentID, ord := newIDs[e.parentID], any(nil)
+		if i == 0 {
+			parentID, ord = op.NewParentID, rootOrd
+		}
+		if _, err := insert.ExecContext(ctx, newID, parentID, ord, now, now, e.id); err != nil {
+			return "", err
+		}
+		if _, err := tags.ExecContext(ctx, newID, e.id); err != nil {
+			return "", err
+		}
+	}
+	return newIDs[op.NodeID], nil
+}
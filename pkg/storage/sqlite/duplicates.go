@@ -0,0 +1,105 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// DuplicateGroup is a set of bookmarks outside the trash that share a
+// canonical URL, oldest first.
+type DuplicateGroup struct {
+	CanonicalURL string
+	NodeIDs      []string
+}
+
+// FindDuplicates groups bookmarks outside the trash by canonical URL and
+// returns the groups with more than one member, ordered by canonical URL,
+// along with the tree version they were read at, so a caller can tell
+// whether the groups went stale before merging them.
+func (s *Store) FindDuplicates(ctx context.Context) ([]DuplicateGroup, string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH RECURSIVE trashed(id) AS (
+			SELECT ?
+			UNION ALL
+			SELECT n.id FROM nodes n JOIN trashed t ON n.parent_id = t.id
+		),
+		live AS (
+			SELECT id, canonical_url, created_at FROM nodes INDEXED BY idx_nodes_url
+			WHERE canonical_url IS NOT NULL
+			  AND kind = 'bookmark'
+			  AND id NOT IN (SELECT id FROM trashed)
+		)
+		SELECT canonical_url, id FROM live
+		WHERE canonical_url IN (SELECT canonical_url FROM live GROUP BY canonical_url HAVING COUNT(*) > 1)
+		ORDER BY canonical_url, created_at, id`, core.TrashID)
+	if err != nil {
+		return nil, "", err
+	}
+	var groups []DuplicateGroup
+	for rows.Next() {
+		var canonical, id string
+		if err := rows.Scan(&canonical, &id); err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].CanonicalURL != canonical {
+			groups = append(groups, DuplicateGroup{CanonicalURL: canonical})
+		}
+		last := &groups[len(groups)-1]
+		last.NodeIDs = append(last.NodeIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	version, err := readTreeVersion(ctx, tx)
+	if err != nil {
+		return nil, "", err
+	}
+	return groups, version, nil
+}
+
+// applyMergeDuplicates keeps the survivor chosen by the op's strategy, copies
+// the other bookmarks' tags onto it, and deletes them.
+func (s *Store) applyMergeDuplicates(ctx context.Context, tx *sql.Tx, op core.MergeDuplicatesOp) error {
+	candidates := make([]core.MergeCandidate, 0, len(op.NodeIDs))
+	for _, id := range op.NodeIDs {
+		c := core.MergeCandidate{ID: id}
+		err := tx.QueryRowContext(ctx, `
+			WITH RECURSIVE anc(id, parent_id) AS (
+				SELECT id, parent_id FROM nodes WHERE id = ?
+				UNION ALL
+				SELECT n.id, n.parent_id FROM nodes n JOIN anc a ON n.id = a.parent_id
+			)
+			SELECT created_at, (SELECT COUNT(*) - 1 FROM anc) FROM nodes WHERE id = ?`, id, id).Scan(&c.CreatedAt, &c.Depth)
+		if errors.Is(err, sql.ErrNoRows) {
+			return core.ErrInvalidNode
+		}
+		if err != nil {
+			return err
+		}
+		candidates = append(candidates, c)
+	}
+	survivor := core.PickSurvivor(candidates, op.Strategy)
+	for _, id := range op.NodeIDs {
+		if id == survivor {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO node_tags(node_id, tag) SELECT ?, tag FROM node_tags WHERE node_id = ?`, survivor, id); err != nil {
+			return err
+		}
+		if err := s.applyDelete(ctx, tx, core.DeleteNodeOp{NodeID: id, Soft: op.Soft}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// historyLimit caps how many batches the undo history keeps.
+const historyLimit = 100
+
+// HistoryEntry is one applied batch in the undo history. Ops reapplies the
+// batch and Inverse reverts it; both reference concrete node IDs.
+type HistoryEntry struct {
+	Seq     int64
+	Ops     []core.Op
+	Inverse []core.Op
+}
+
+// NextUndo returns the most recent batch that has not been undone, or nil
+// when there is nothing to undo.
+func (s *Store) NextUndo(ctx context.Context) (*HistoryEntry, error) {
+	return s.historyEntry(ctx, `SELECT seq, ops, inverse FROM history WHERE undone = 0 ORDER BY seq DESC LIMIT 1`)
+}
+
+// NextRedo returns the most recently undone batch, or nil when there is
+// nothing to redo.
+func (s *Store) NextRedo(ctx context.Context) (*HistoryEntry, error) {
+	return s.historyEntry(ctx, `SELECT seq, ops, inverse FROM history WHERE undone = 1 ORDER BY seq ASC LIMIT 1`)
+}
+
+func (s *Store) historyEntry(ctx context.Context, query string) (*HistoryEntry, error) {
+	var (
+		entry        HistoryEntry
+		ops, inverse string
+	)
+	err := s.db.QueryRowContext(ctx, query).Scan(&entry.Seq, &ops, &inverse)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.Ops, err = core.UnmarshalOps([]byte(ops)); err != nil {
+		return nil, err
+	}
+	if entry.Inverse, err = core.UnmarshalOps([]byte(inverse)); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Undo applies entry's inverse batch and marks the entry undone. The inverse
+// of the undo itself becomes the entry's redo batch.
+func (s *Store) Undo(ctx context.Context, entry HistoryEntry, opts ApplyOptions) (ApplyResult, error) {
+	return s.applyBatch(ctx, entry.Inverse, opts, OriginUndo, func(tx *sql.Tx, applied, inverse []core.Op) error {
+		return s.updateHistory(ctx, tx, entry.Seq, true, inverse, applied)
+	})
+}
+
+// Redo reapplies an undone entry and returns it to the undo stack.
+func (s *Store) Redo(ctx context.Context, entry HistoryEntry, opts ApplyOptions) (ApplyResult, error) {
+	return s.applyBatch(ctx, entry.Ops, opts, OriginRedo, func(tx *sql.Tx, applied, inverse []core.Op) error {
+		return s.updateHistory(ctx, tx, entry.Seq, false, applied, inverse)
+	})
+}
+
+// pushHistory records a new batch, discarding any redo entries and trimming
+// the history to historyLimit.
+func (s *Store) pushHistory(ctx context.Context, tx *sql.Tx, ops, inverse []core.Op) error {
+	opsJSON, err := core.MarshalOps(ops)
+	if err != nil {
+		return err
+	}
+	inverseJSON, err := core.MarshalOps(inverse)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM history WHERE undone = 1`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO history(ops, inverse, created_at) VALUES(?,?,?)`,
+		string(opsJSON), string(inverseJSON), time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM history WHERE seq NOT IN (SELECT seq FROM history ORDER BY seq DESC LIMIT ?)`, historyLimit)
+	return err
+}
+
+// updateHistory flips entry seq between the undo and redo stacks, storing the
+// batches that now move it back the other way.
+func (s *Store) updateHistory(ctx context.Context, tx *sql.Tx, seq int64, undone bool, ops, inverse []core.Op) error {
+	opsJSON, err := core.MarshalOps(ops)
+	if err != nil {
+		return err
+	}
+	inverseJSON, err := core.MarshalOps(inverse)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE history SET ops = ?, inverse = ?, undone = ? WHERE seq = ? AND undone = ?`,
+		string(opsJSON), string(inverseJSON), undone, seq, !undone)
+	return wrapRowsAffected(res, err)
+}
+
+// inverseOf returns the ops that revert op, computed from the state before op
+// is applied. Ops that create nodes return nil; their inverse is a delete of
+// the created node, which is only known once op has run.
+func (s *Store) inverseOf(ctx context.Context, tx *sql.Tx, op core.Op) ([]core.Op, error) {
+	var id string
+	switch v := op.(type) {
+	case core.AddFolderOp, core.AddBookmarkOp, core.AddSeparatorOp, core.AddSmartFolderOp, core.SaveSessionOp, core.CopyNodeOp:
+		return nil, nil
+	case core.DeleteNodeOp:
+		nodes, err := s.snapshotSubtree(ctx, tx, v.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		return []core.Op{core.PutNodesOp{Nodes: nodes}}, nil
+	case core.PutNodesOp:
+		return s.inverseOfPut(ctx, tx, v)
+	case core.SortChildrenOp:
+		return s.inverseOfSort(ctx, tx, v)
+	case core.ReplaceOp:
+		return s.inverseOfReplace(ctx, tx, v)
+	case core.MergeFoldersOp:
+		return s.inverseOfMergeFolders(ctx, tx, v)
+	case core.MergeDuplicatesOp:
+		nodes := make([]core.Node, 0, len(v.NodeIDs))
+		for _, nodeID := range v.NodeIDs {
+			node, ok, err := s.snapshotNode(ctx, tx, nodeID)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				nodes = append(nodes, node)
+			}
+		}
+		return []core.Op{core.PutNodesOp{Nodes: nodes}}, nil
+	case core.RenameNodeOp:
+		id = v.NodeID
+	case core.MoveNodeOp:
+		id = v.NodeID
+	case core.RestoreNodeOp:
+		id = v.NodeID
+	case core.UpdateBookmarkOp:
+		id = v.NodeID
+	case core.UpdateFolderOp:
+		id = v.NodeID
+	case core.AddTagsOp:
+		id = v.NodeID
+	case core.RemoveTagsOp:
+		id = v.NodeID
+	default:
+		return nil, nil
+	}
+	node, ok, err := s.snapshotNode(ctx, tx, id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []core.Op{core.PutNodesOp{Nodes: []core.Node{node}}}, nil
+}
+
+// inverseOfPut restores the records a put overwrites and deletes the nodes it
+// creates. Restores run first so nodes moved under a created folder are moved
+// back out before that folder is deleted.
+func (s *Store) inverseOfPut(ctx context.Context, tx *sql.Tx, op core.PutNodesOp) ([]core.Op, error) {
+	var existing []core.Node
+	created := make(map[string]bool)
+	for _, n := range op.Nodes {
+		node, ok, err := s.snapshotNode(ctx, tx, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			existing = append(existing, node)
+		} else {
+			created[n.ID] = true
+		}
+	}
+	var inverse []core.Op
+	if len(existing) > 0 {
+		inverse = append(inverse, core.PutNodesOp{Nodes: existing})
+	}
+	for _, n := range op.Nodes {
+		if created[n.ID] && (n.ParentID == nil || !created[*n.ParentID]) {
+			inverse = append(inverse, core.DeleteNodeOp{NodeID: n.ID, Recursive: true})
+		}
+	}
+	return inverse, nil
+}
+
+// inverseOfSort restores the sorted folders' children to their current ords.
+func (s *Store) inverseOfSort(ctx context.Context, tx *sql.Tx, op core.SortChildrenOp) ([]core.Op, error) {
+	var nodes []core.Node
+	if op.Recursive {
+		subtree, err := s.snapshotSubtree(ctx, tx, op.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		// The folder itself keeps its place; only what lies below it moves.
+		if len(subtree) > 0 {
+			nodes = subtree[1:]
+		}
+	} else {
+		rows, err := tx.QueryContext(ctx, `SELECT `+nodeColumns+` FROM nodes WHERE parent_id = ? ORDER BY ord`, op.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		if nodes, err = s.scanSnapshot(ctx, tx, rows); err != nil {
+			return nil, err
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	return []core.Op{core.PutNodesOp{Nodes: nodes}}, nil
+}
+
+// snapshotNode returns the full stored record of id, reporting false when the
+// node does not exist.
+func (s *Store) snapshotNode(ctx context.Context, tx *sql.Tx, id string) (core.Node, bool, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id)
+	if err != nil {
+		return core.Node{}, false, err
+	}
+	nodes, err := s.scanSnapshot(ctx, tx, rows)
+	if err != nil || len(nodes) == 0 {
+		return core.Node{}, false, err
+	}
+	return nodes[0], true, nil
+}
+
+// snapshotSubtree returns the full stored records of id and its descendants,
+// parents before children.
+func (s *Store) snapshotSubtree(ctx context.Context, tx *sql.Tx, id string) ([]core.Node, error) {
+	rows, err := tx.QueryContext(ctx, `
+		WITH RECURSIVE sub(id, depth) AS (
+			SELECT ?, 0
+			UNION ALL
+			SELECT n.id, sub.depth + 1 FROM nodes n JOIN sub ON n.parent_id = sub.id
+		)
+		SELECT `+nodeColumns+`
+		FROM sub JOIN nodes USING (id)
+		ORDER BY sub.depth, parent_id, ord`, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanSnapshot(ctx, tx, rows)
+}
+
+// scanSnapshot reads node rows and fills in their tags and trash entries.
+func (s *Store) scanSnapshot(ctx context.Context, tx *sql.Tx, rows *sql.Rows) ([]core.Node, error) {
+	var nodes []core.Node
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		tags, err := tx.QueryContext(ctx, `SELECT tag FROM node_tags WHERE node_id = ? ORDER BY tag`, nodes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for tags.Next() {
+			var tag string
+			if err := tags.Scan(&tag); err != nil {
+				tags.Close()
+				return nil, err
+			}
+			nodes[i].Tags = append(nodes[i].Tags, tag)
+		}
+		tags.Close()
+		if err := tags.Err(); err != nil {
+			return nil, err
+		}
+		var info core.TrashInfo
+		err = tx.QueryRowContext(ctx, `SELECT orig_parent_id, orig_index, deleted_at FROM trash_entries WHERE node_id = ?`, nodes[i].ID).
+			Scan(&info.ParentID, &info.Index, &info.DeletedAt)
+		switch {
+		case err == nil:
+			nodes[i].Trashed = &info
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// applyPutNodes writes full node records, replacing their tags and trash
+// entries.
+func (s *Store) applyPutNodes(ctx context.Context, tx *sql.Tx, op core.PutNodesOp) error {
+	for _, node := range op.Nodes {
+		query, err := encodeQuery(node.Query)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO nodes(id, parent_id, kind, title, url, canonical_url, notes, query, ord, created_at, updated_at)
+			VALUES(?,?,?,?,?,?,?,?,?,?,?)
+			ON CONFLICT(id) DO UPDATE SET
+				parent_id = excluded.parent_id,
+				kind = excluded.kind,
+				title = excluded.title,
+				url = excluded.url,
+				canonical_url = excluded.canonical_url,
+				notes = excluded.notes,
+				query = excluded.query,
+				ord = excluded.ord,
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at`,
+			node.ID, node.ParentID, string(node.Kind), node.Title, node.URL, s.canonicalURL(node.URL), node.Notes, query, node.Ord, node.CreatedAt, node.UpdatedAt); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM node_tags WHERE node_id = ?`, node.ID); err != nil {
+			return err
+		}
+		for _, tag := range node.Tags {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO node_tags(node_id, tag) VALUES(?,?)`, node.ID, tag); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM trash_entries WHERE node_id = ?`, node.ID); err != nil {
+			return err
+		}
+		if node.Trashed != nil {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO trash_entries(node_id, orig_parent_id, orig_index, deleted_at) VALUES(?,?,?,?)`,
+				node.ID, node.Trashed.ParentID, node.Trashed.Index, node.Trashed.DeletedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// applyMergeFolders moves the source folder's children into the target in
+// ord order, drops duplicates when op.Dedupe is set, and removes the source.
+func (s *Store) applyMergeFolders(ctx context.Context, tx *sql.Tx, op core.MergeFoldersOp) error {
+	// kept maps a URL key to the bookmark in the target that carries it.
+	kept := make(map[string]string)
+	if op.Dedupe {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, COALESCE(canonical_url, url) FROM nodes
+			WHERE parent_id = ? AND kind = 'bookmark' AND url IS NOT NULL
+			ORDER BY ord ASC, id ASC`, op.TargetID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id, key string
+			if err := rows.Scan(&id, &key); err != nil {
+				rows.Close()
+				return err
+			}
+			if _, ok := kept[key]; !ok {
+				kept[key] = id
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	type child struct {
+		id  string
+		key sql.NullString
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, CASE WHEN kind = 'bookmark' THEN COALESCE(canonical_url, url) END FROM nodes
+		WHERE parent_id = ? ORDER BY ord ASC, id ASC`, op.SourceID)
+	if err != nil {
+		return err
+	}
+	var children []child
+	for rows.Next() {
+		var c child
+		if err := rows.Scan(&c.id, &c.key); err != nil {
+			rows.Close()
+			return err
+		}
+		children = append(children, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	for _, c := range children {
+		if op.Dedupe && c.key.Valid {
+			if keep, ok := kept[c.key.String]; ok {
+				if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO node_tags(node_id, tag) SELECT ?, tag FROM node_tags WHERE node_id = ?`, keep, c.id); err != nil {
+					return err
+				}
+				if err := s.applyDelete(ctx, tx, core.DeleteNodeOp{NodeID: c.id, Recursive: true, Soft: op.Soft}); err != nil {
+					return err
+				}
+				continue
+			}
+			kept[c.key.String] = c.id
+		}
+		// Interleaving keeps the source ords and renumbers the merged list
+		// below; appending places each child after the target's last.
+		query, args := `UPDATE nodes SET parent_id = ?, updated_at = ? WHERE id = ?`, []any{op.TargetID, now, c.id}
+		if !op.Interleave {
+			ord, err := s.calcOrd(ctx, tx, op.TargetID, nil)
+			if err != nil {
+				return err
+			}
+			query, args = `UPDATE nodes SET parent_id = ?, ord = ?, updated_at = ? WHERE id = ?`, []any{op.TargetID, ord, now, c.id}
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err := wrapRowsAffected(res, err); err != nil {
+			return err
+		}
+	}
+	if op.Interleave {
+		if err := s.rebalance(ctx, tx, op.TargetID); err != nil {
+			return err
+		}
+	}
+	return s.applyDelete(ctx, tx, core.DeleteNodeOp{NodeID: op.SourceID, Soft: op.Soft})
+}
+
+// inverseOfMergeFolders snapshots the source with its children and the
+// target's children, covering every parent, ord, and tag the merge changes.
+func (s *Store) inverseOfMergeFolders(ctx context.Context, tx *sql.Tx, op core.MergeFoldersOp) ([]core.Op, error) {
+	source, ok, err := s.snapshotNode(ctx, tx, op.SourceID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	nodes := []core.Node{source}
+	for _, parentID := range []string{op.SourceID, op.TargetID} {
+		rows, err := tx.QueryContext(ctx, `SELECT `+nodeColumns+` FROM nodes WHERE parent_id = ? ORDER BY ord`, parentID)
+		if err != nil {
+			return nil, err
+		}
+		children, err := s.scanSnapshot(ctx, tx, rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, children...)
+	}
+	return []core.Op{core.PutNodesOp{Nodes: nodes}}, nil
+}
@@ -0,0 +1,83 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// Origins recorded in the op log for each kind of batch.
+const (
+	OriginApply      = "apply"
+	OriginUndo       = "undo"
+	OriginRedo       = "redo"
+	OriginEmptyTrash = "empty_trash"
+	OriginPurgeTrash = "purge_trash"
+)
+
+// OpLogEntry is one committed batch in the append-only op log.
+type OpLogEntry struct {
+	Seq       int64
+	BatchID   string
+	AppliedAt int64
+	Client    string
+	Origin    string
+	// Ops are the batch as applied, with temp IDs resolved.
+	Ops []core.Op
+	// CreatedIDs holds the ID of the node each op created, or "" for ops
+	// that create none. Only the top node is listed: the bookmarks of a
+	// saved session and the descendants of a copy are not.
+	CreatedIDs []string
+}
+
+// appendOpLog records a batch inside tx and returns its batch ID.
+func (s *Store) appendOpLog(ctx context.Context, tx *sql.Tx, client, origin string, ops []core.Op, createdIDs []string) (string, error) {
+	opsJSON, err := core.MarshalOps(ops)
+	if err != nil {
+		return "", err
+	}
+	createdJSON, err := json.Marshal(createdIDs)
+	if err != nil {
+		return "", err
+	}
+	batchID := core.NewBatchID()
+	_, err = tx.ExecContext(ctx, `INSERT INTO op_log(batch_id, applied_at, client, origin, ops, created_ids) VALUES(?,?,?,?,?,?)`,
+		batchID, time.Now().UnixMilli(), client, origin, string(opsJSON), string(createdJSON))
+	return batchID, err
+}
+
+// OpLog returns up to limit entries with a sequence number greater than
+// afterSeq, oldest first.
+func (s *Store) OpLog(ctx context.Context, afterSeq int64, limit int) ([]OpLogEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, batch_id, applied_at, client, origin, ops, created_ids
+		FROM op_log
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?`, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []OpLogEntry
+	for rows.Next() {
+		var (
+			entry            OpLogEntry
+			opsJSON, created string
+		)
+		if err := rows.Scan(&entry.Seq, &entry.BatchID, &entry.AppliedAt, &entry.Client, &entry.Origin, &opsJSON, &created); err != nil {
+			return nil, err
+		}
+		if entry.Ops, err = core.UnmarshalOps([]byte(opsJSON)); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(created), &entry.CreatedIDs); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,76 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// planReplace computes the rewrites op makes below its scope node and returns
+// them with the stored records of the nodes they change.
+func (s *Store) planReplace(ctx context.Context, tx *sql.Tx, op core.ReplaceOp) ([]core.Replacement, map[string]core.Node, error) {
+	subtree, err := s.snapshotSubtree(ctx, tx, op.NodeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := core.Tree{Nodes: make(map[string]core.Node, len(subtree)), Children: make(map[string][]string)}
+	for _, node := range subtree {
+		tree.Nodes[node.ID] = node
+		if node.ID != op.NodeID && node.ParentID != nil {
+			tree.Children[*node.ParentID] = append(tree.Children[*node.ParentID], node.ID)
+		}
+	}
+	plan, err := core.PlanReplace(tree, op)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := make(map[string]core.Node, len(plan))
+	for _, r := range plan {
+		changed[r.NodeID] = tree.Nodes[r.NodeID]
+	}
+	return plan, changed, nil
+}
+
+func (s *Store) applyReplace(ctx context.Context, tx *sql.Tx, op core.ReplaceOp) error {
+	if op.DryRun {
+		return nil
+	}
+	plan, _, err := s.planReplace(ctx, tx, op)
+	if err != nil {
+		return err
+	}
+	for _, r := range plan {
+		value := r.New
+		var err error
+		if r.Field == core.ReplaceURL {
+			err = s.applyUpdate(ctx, tx, r.NodeID, nil, &value, nil, nil)
+		} else {
+			err = s.applyUpdate(ctx, tx, r.NodeID, &value, nil, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inverseOfReplace snapshots every node the replace rewrites.
+func (s *Store) inverseOfReplace(ctx context.Context, tx *sql.Tx, op core.ReplaceOp) ([]core.Op, error) {
+	if op.DryRun {
+		return nil, nil
+	}
+	plan, changed, err := s.planReplace(ctx, tx, op)
+	if err != nil || len(plan) == 0 {
+		return nil, err
+	}
+	nodes := make([]core.Node, 0, len(changed))
+	seen := make(map[string]bool, len(changed))
+	for _, r := range plan {
+		if !seen[r.NodeID] {
+			seen[r.NodeID] = true
+			nodes = append(nodes, changed[r.NodeID])
+		}
+	}
+	return []core.Op{core.PutNodesOp{Nodes: nodes}}, nil
+}
@@ -3,10 +3,12 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +19,9 @@ import (
 
 // Store owns the SQLite database for a profile.
 type Store struct {
-	db   *sql.DB
-	path string
+	db       *sql.DB
+	path     string
+	urlRules core.URLRules
 }
 
 // Path returns the underlying SQLite file path.
@@ -31,11 +34,19 @@ func Open(path string) (*Store, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
 		return nil, err
 	}
-	db, err := sql.Open("sqlite", path)
+	// foreign_keys is per-connection; set it in the DSN so every pooled
+	// connection enforces ON DELETE CASCADE, not just the one Init ran on.
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)")
 	if err != nil {
 		return nil, err
 	}
-	return &Store{db: db, path: path}, nil
+	return &Store{db: db, path: path, urlRules: core.DefaultURLRules()}, nil
+}
+
+// SetURLRules replaces the rules used to derive canonical URLs. Call it
+// before Init so stored canonical URLs are brought up to date.
+func (s *Store) SetURLRules(rules core.URLRules) {
+	s.urlRules = rules
 }
 
 // Close releases database resources.
@@ -65,7 +76,10 @@ func (s *Store) Init(ctx context.Context) error {
 	if err := s.applySchema(ctx); err != nil {
 		return err
 	}
-	return s.ensureRoot(ctx)
+	if err := s.ensureSystemNodes(ctx); err != nil {
+		return err
+	}
+	return s.canonicalizeURLs(ctx)
 }
 
 func (s *Store) applySchema(ctx context.Context) error {
@@ -88,28 +102,231 @@ func (s *Store) applySchema(ctx context.Context) error {
 		`CREATE INDEX IF NOT EXISTS idx_nodes_parent_ord ON nodes(parent_id, ord);`,
 		`CREATE INDEX IF NOT EXISTS idx_nodes_title_nocase ON nodes(title COLLATE NOCASE);`,
 		`CREATE INDEX IF NOT EXISTS idx_nodes_url ON nodes(url);`,
+		`CREATE TABLE IF NOT EXISTS node_tags (
+			node_id TEXT NOT NULL REFERENCES nodes(id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (node_id, tag)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_node_tags_tag ON node_tags(tag);`,
 	}
 	for _, stmt := range ddl {
 		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
 			return fmt.Errorf("apply schema: %w", err)
 		}
 	}
+	return s.migrate(ctx)
+}
+
+// migration upgrades the schema to version; statements run in one transaction.
+type migration struct {
+	version int
+	stmts   []string
+	// rebuildsTables disables foreign key enforcement around the transaction
+	// so tables can be recreated without cascading deletes; the result is
+	// checked with foreign_key_check before committing.
+	rebuildsTables bool
+}
+
+var migrations = []migration{
+	{
+		version: 2,
+		stmts: []string{
+			`ALTER TABLE nodes ADD COLUMN notes TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version: 3,
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS trash_entries (
+				node_id TEXT PRIMARY KEY REFERENCES nodes(id) ON DELETE CASCADE,
+				orig_parent_id TEXT NOT NULL,
+				orig_index INTEGER NOT NULL,
+				deleted_at INTEGER NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_trash_entries_deleted_at ON trash_entries(deleted_at);`,
+		},
+	},
+	{
+		version: 4,
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS history (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				ops TEXT NOT NULL,
+				inverse TEXT NOT NULL,
+				undone INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL
+			);`,
+		},
+	},
+	{
+		version: 5,
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS op_log (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				batch_id TEXT NOT NULL UNIQUE,
+				applied_at INTEGER NOT NULL,
+				client TEXT NOT NULL DEFAULT '',
+				origin TEXT NOT NULL,
+				ops TEXT NOT NULL,
+				created_ids TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version: 6,
+		stmts: []string{
+			`INSERT OR IGNORE INTO meta(key, value) VALUES ('treeVersion', '0');`,
+		},
+	},
+	{
+		version:        7,
+		rebuildsTables: true,
+		stmts: []string{
+			`CREATE TABLE nodes_new (
+				id TEXT PRIMARY KEY,
+				parent_id TEXT REFERENCES nodes(id) ON DELETE CASCADE,
+				kind TEXT NOT NULL CHECK (kind IN ('folder','bookmark','separator')),
+				title TEXT NOT NULL,
+				url TEXT,
+				ord REAL NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL,
+				notes TEXT NOT NULL DEFAULT ''
+			);`,
+			`INSERT INTO nodes_new(id, parent_id, kind, title, url, ord, created_at, updated_at, notes)
+				SELECT id, parent_id, kind, title, url, ord, created_at, updated_at, notes FROM nodes;`,
+			`DROP TABLE nodes;`,
+			`ALTER TABLE nodes_new RENAME TO nodes;`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_parent_ord ON nodes(parent_id, ord);`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_title_nocase ON nodes(title COLLATE NOCASE);`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_url ON nodes(url);`,
+		},
+	},
+	{
+		version:        8,
+		rebuildsTables: true,
+		stmts: []string{
+			`CREATE TABLE nodes_new (
+				id TEXT PRIMARY KEY,
+				parent_id TEXT REFERENCES nodes(id) ON DELETE CASCADE,
+				kind TEXT NOT NULL CHECK (kind IN ('folder','bookmark','separator','smart')),
+				title TEXT NOT NULL,
+				url TEXT,
+				ord REAL NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL,
+				notes TEXT NOT NULL DEFAULT '',
+				query TEXT
+			);`,
+			`INSERT INTO nodes_new(id, parent_id, kind, title, url, ord, created_at, updated_at, notes)
+				SELECT id, parent_id, kind, title, url, ord, created_at, updated_at, notes FROM nodes;`,
+			`DROP TABLE nodes;`,
+			`ALTER TABLE nodes_new RENAME TO nodes;`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_parent_ord ON nodes(parent_id, ord);`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_title_nocase ON nodes(title COLLATE NOCASE);`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_url ON nodes(url);`,
+		},
+	},
+	{
+		version: 9,
+		stmts: []string{
+			`ALTER TABLE nodes ADD COLUMN canonical_url TEXT;`,
+			`CREATE INDEX IF NOT EXISTS idx_nodes_canonical_url ON nodes(canonical_url);`,
+		},
+	},
+	{
+		// URL lookups all go through the canonical form, so idx_nodes_url
+		// covers it in place of the URL as entered.
+		version: 10,
+		stmts: []string{
+			`DROP INDEX IF EXISTS idx_nodes_canonical_url;`,
+			`DROP INDEX IF EXISTS idx_nodes_url;`,
+			`CREATE INDEX idx_nodes_url ON nodes(canonical_url);`,
+		},
+	},
+}
+
+// SchemaVersion reports the schema version recorded in meta.
+func (s *Store) SchemaVersion(ctx context.Context) (int, error) {
+	var raw string
+	if err := s.db.QueryRowContext(ctx, `SELECT value FROM meta WHERE key = 'schemaVersion'`).Scan(&raw); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(raw)
+}
+
+func (s *Store) migrate(ctx context.Context) error {
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	// foreign_keys is per-connection and cannot change inside a transaction,
+	// so migrations run on one dedicated connection.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migrate to v%d: %w", m.version, err)
+		}
+		current = m.version
+	}
 	return nil
 }
 
-func (s *Store) ensureRoot(ctx context.Context) error {
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	if m.rebuildsTables {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range m.stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if m.rebuildsTables {
+		var violations int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&violations); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if violations > 0 {
+			tx.Rollback()
+			return fmt.Errorf("%d foreign key violations after rebuild", violations)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE meta SET value = ? WHERE key = 'schemaVersion'`, strconv.Itoa(m.version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ensureSystemNodes(ctx context.Context) error {
 	now := time.Now().UnixMilli()
 	_, err := s.db.ExecContext(ctx, `
 		INSERT OR IGNORE INTO nodes(id, parent_id, kind, title, ord, created_at, updated_at)
-		VALUES ('root', NULL, 'folder', 'Root', 0, ?, ?);
-	`, now, now)
+		VALUES ('root', NULL, 'folder', 'Root', 0, ?, ?), (?, NULL, 'folder', 'Trash', 1, ?, ?);
+	`, now, now, core.TrashID, now, now)
 	return err
 }
 
 // LoadTree returns the canonical tree snapshot.
 func (s *Store) LoadTree(ctx context.Context) (core.Tree, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, parent_id, kind, title, url, ord, created_at, updated_at
+		SELECT `+nodeColumns+`
 		FROM nodes
 		ORDER BY parent_id IS NOT NULL, parent_id, ord;
 	`)
@@ -121,39 +338,30 @@ func (s *Store) LoadTree(ctx context.Context) (core.Tree, error) {
 	nodes := make(map[string]core.Node)
 	children := make(map[string][]string)
 	for rows.Next() {
-		var (
-			id       string
-			parentID *string
-			kind     string
-			title    string
-			url      *string
-			ord      float64
-			created  int64
-			updated  int64
-		)
-		if err := rows.Scan(&id, &parentID, &kind, &title, &url, &ord, &created, &updated); err != nil {
+		node, err := scanNode(rows)
+		if err != nil {
 			return core.Tree{}, err
 		}
-		node := core.Node{
-			ID:        id,
-			Kind:      core.NodeKind(kind),
-			Title:     title,
-			URL:       url,
-			ParentID:  parentID,
-			Ord:       ord,
-			CreatedAt: created,
-			UpdatedAt: updated,
-		}
-		nodes[id] = node
-		if parentID != nil {
-			children[*parentID] = append(children[*parentID], id)
+		nodes[node.ID] = node
+		if node.ParentID != nil {
+			children[*node.ParentID] = append(children[*node.ParentID], node.ID)
 		}
 	}
 	if err := rows.Err(); err != nil {
 		return core.Tree{}, err
 	}
+	if err := s.loadTags(ctx, nodes); err != nil {
+		return core.Tree{}, err
+	}
+	if err := s.loadTrashEntries(ctx, nodes); err != nil {
+		return core.Tree{}, err
+	}
+	var version string
+	if err := s.db.QueryRowContext(ctx, `SELECT value FROM meta WHERE key = 'treeVersion'`).Scan(&version); err != nil {
+		return core.Tree{}, fmt.Errorf("read tree version: %w", err)
+	}
 	tree := core.Tree{
-		Version:  "uninitialized",
+		Version:  version,
 		RootID:   "root",
 		Nodes:    nodes,
 		Children: children,
@@ -161,82 +369,269 @@ func (s *Store) LoadTree(ctx context.Context) (core.Tree, error) {
 	return tree, nil
 }
 
-// ApplyOps applies a batch atomically.
-func (s *Store) ApplyOps(ctx context.Context, ops []core.Op) (core.Tree, error) {
+// nodeColumns lists the nodes columns read by scanNode, in order.
+const nodeColumns = `id, parent_id, kind, title, url, canonical_url, notes, query, ord, created_at, updated_at`
+
+func scanNode(rows *sql.Rows) (core.Node, error) {
+	var (
+		node  core.Node
+		kind  string
+		query *string
+	)
+	if err := rows.Scan(&node.ID, &node.ParentID, &kind, &node.Title, &node.URL, &node.CanonicalURL, &node.Notes, &query, &node.Ord, &node.CreatedAt, &node.UpdatedAt); err != nil {
+		return core.Node{}, err
+	}
+	node.Kind = core.NodeKind(kind)
+	if query != nil {
+		node.Query = &core.SmartQuery{}
+		if err := json.Unmarshal([]byte(*query), node.Query); err != nil {
+			return core.Node{}, fmt.Errorf("decode query of %s: %w", node.ID, err)
+		}
+	}
+	return node, nil
+}
+
+// encodeQuery serializes a smart folder query for the query column.
+func encodeQuery(q *core.SmartQuery) (*string, error) {
+	if q == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	out := string(raw)
+	return &out, nil
+}
+
+func (s *Store) loadTags(ctx context.Context, nodes map[string]core.Node) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT node_id, tag FROM node_tags ORDER BY node_id, tag`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		node, ok := nodes[id]
+		if !ok {
+			continue
+		}
+		node.Tags = append(node.Tags, tag)
+		nodes[id] = node
+	}
+	return rows.Err()
+}
+
+func (s *Store) loadTrashEntries(ctx context.Context, nodes map[string]core.Node) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT node_id, orig_parent_id, orig_index, deleted_at FROM trash_entries`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   string
+			info core.TrashInfo
+		)
+		if err := rows.Scan(&id, &info.ParentID, &info.Index, &info.DeletedAt); err != nil {
+			return err
+		}
+		node, ok := nodes[id]
+		if !ok {
+			continue
+		}
+		node.Trashed = &info
+		nodes[id] = node
+	}
+	return rows.Err()
+}
+
+// ApplyOptions describes who is applying a batch.
+type ApplyOptions struct {
+	// Client identifies the caller in the op log, e.g. "chrome-extension".
+	Client string
+}
+
+// ApplyResult reports the outcome of a committed batch.
+type ApplyResult struct {
+	Tree core.Tree
+	// BatchID is the op log identifier of the batch.
+	BatchID string
+	// TempIDs maps client temp IDs in the batch to the node IDs assigned.
+	TempIDs map[string]string
+}
+
+// ApplyOps applies a batch atomically. References to temp IDs assigned by
+// earlier ops in the batch resolve to the node IDs generated for them. The
+// batch is appended to the op log and, with its inverse, to the undo history.
+func (s *Store) ApplyOps(ctx context.Context, ops []core.Op, opts ApplyOptions) (ApplyResult, error) {
+	return s.applyBatch(ctx, ops, opts, OriginApply, func(tx *sql.Tx, applied, inverse []core.Op) error {
+		return s.pushHistory(ctx, tx, applied, inverse)
+	})
+}
+
+// applyBatch applies ops in one transaction and logs them under origin.
+// Before committing it calls record with the ops as applied (temp IDs
+// resolved) and the batch that reverses them.
+func (s *Store) applyBatch(ctx context.Context, ops []core.Op, opts ApplyOptions, origin string, record func(tx *sql.Tx, applied, inverse []core.Op) error) (ApplyResult, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return core.Tree{}, err
+		return ApplyResult{}, err
+	}
+	tempIDs := make(map[string]string)
+	resolve := func(id string) string {
+		if real, ok := tempIDs[id]; ok {
+			return real
+		}
+		return id
 	}
+	applied := make([]core.Op, 0, len(ops))
+	createdIDs := make([]string, 0, len(ops))
+	var inverse []core.Op
 	for _, op := range ops {
-		switch v := op.(type) {
-		case core.AddFolderOp:
-			if err := s.applyAddFolder(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.AddBookmarkOp:
-			if err := s.applyAddBookmark(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.RenameNodeOp:
-			if err := s.applyRename(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.MoveNodeOp:
-			if err := s.applyMove(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.DeleteNodeOp:
-			if err := s.applyDelete(ctx, tx, v.NodeID); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.UpdateBookmarkOp:
-			if err := s.applyUpdateBookmark(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		case core.SaveSessionOp:
-			if err := s.applySaveSession(ctx, tx, v); err != nil {
-				tx.Rollback()
-				return core.Tree{}, err
-			}
-		default:
+		op = core.ResolveOpIDs(op, resolve)
+		undo, err := s.inverseOf(ctx, tx, op)
+		if err != nil {
 			tx.Rollback()
-			return core.Tree{}, fmt.Errorf("unsupported op %T", op)
+			return ApplyResult{}, err
 		}
+		id, err := s.applyOp(ctx, tx, op)
+		if err != nil {
+			tx.Rollback()
+			return ApplyResult{}, err
+		}
+		if id != "" {
+			undo = []core.Op{core.DeleteNodeOp{NodeID: id, Recursive: true}}
+		}
+		if temp := core.CreatedTempID(op); temp != "" {
+			tempIDs[temp] = id
+		}
+		applied = append(applied, op)
+		createdIDs = append(createdIDs, id)
+		inverse = append(undo, inverse...)
+	}
+	batchID, err := s.appendOpLog(ctx, tx, opts.Client, origin, applied, createdIDs)
+	if err != nil {
+		tx.Rollback()
+		return ApplyResult{}, err
+	}
+	if err := bumpTreeVersion(ctx, tx); err != nil {
+		tx.Rollback()
+		return ApplyResult{}, err
+	}
+	if err := record(tx, applied, inverse); err != nil {
+		tx.Rollback()
+		return ApplyResult{}, err
 	}
 	if err := tx.Commit(); err != nil {
-		return core.Tree{}, err
+		return ApplyResult{}, err
+	}
+	tree, err := s.LoadTree(ctx)
+	if err != nil {
+		return ApplyResult{}, err
+	}
+	return ApplyResult{Tree: tree, BatchID: batchID, TempIDs: tempIDs}, nil
+}
+
+// applyOp applies a single op and returns the ID of the node it created, if any.
+func (s *Store) applyOp(ctx context.Context, tx *sql.Tx, op core.Op) (string, error) {
+	switch v := op.(type) {
+	case core.AddFolderOp:
+		return s.applyAddFolder(ctx, tx, v)
+	case core.AddBookmarkOp:
+		return s.applyAddBookmark(ctx, tx, v)
+	case core.AddSeparatorOp:
+		return s.applyAddSeparator(ctx, tx, v)
+	case core.AddSmartFolderOp:
+		return s.applyAddSmartFolder(ctx, tx, v)
+	case core.RenameNodeOp:
+		return "", s.applyRename(ctx, tx, v)
+	case core.MoveNodeOp:
+		return "", s.applyMove(ctx, tx, v)
+	case core.DeleteNodeOp:
+		return "", s.applyDelete(ctx, tx, v)
+	case core.MergeDuplicatesOp:
+		return "", s.applyMergeDuplicates(ctx, tx, v)
+	case core.SortChildrenOp:
+		return "", s.applySortChildren(ctx, tx, v)
+	case core.CopyNodeOp:
+		return s.applyCopyNode(ctx, tx, v)
+	case core.ReplaceOp:
+		return "", s.applyReplace(ctx, tx, v)
+	case core.MergeFoldersOp:
+		return "", s.applyMergeFolders(ctx, tx, v)
+	case core.RestoreNodeOp:
+		return "", s.applyRestore(ctx, tx, v)
+	case core.UpdateBookmarkOp:
+		return "", s.applyUpdate(ctx, tx, v.NodeID, v.Title, v.URL, v.Notes, nil)
+	case core.UpdateFolderOp:
+		return "", s.applyUpdate(ctx, tx, v.NodeID, v.Title, nil, v.Notes, v.Query)
+	case core.AddTagsOp:
+		return "", s.applyAddTags(ctx, tx, v)
+	case core.RemoveTagsOp:
+		return "", s.applyRemoveTags(ctx, tx, v)
+	case core.SaveSessionOp:
+		return s.applySaveSession(ctx, tx, v)
+	case core.PutNodesOp:
+		return "", s.applyPutNodes(ctx, tx, v)
+	default:
+		return "", fmt.Errorf("unsupported op %T", op)
 	}
-	return s.LoadTree(ctx)
 }
 
-func (s *Store) applyAddFolder(ctx context.Context, tx *sql.Tx, op core.AddFolderOp) error {
+func (s *Store) applyAddFolder(ctx context.Context, tx *sql.Tx, op core.AddFolderOp) (string, error) {
 	ord, err := s.calcOrd(ctx, tx, op.ParentID, op.Index)
 	if err != nil {
-		return err
+		return "", err
 	}
 	now := time.Now().UnixMilli()
 	id := core.NewNodeID()
 	_, err = tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?)`,
 		id, op.ParentID, string(core.KindFolder), op.Title, ord, now, now)
-	return err
+	return id, err
 }
 
-func (s *Store) applyAddBookmark(ctx context.Context, tx *sql.Tx, op core.AddBookmarkOp) error {
+func (s *Store) applyAddBookmark(ctx context.Context, tx *sql.Tx, op core.AddBookmarkOp) (string, error) {
 	ord, err := s.calcOrd(ctx, tx, op.ParentID, op.Index)
 	if err != nil {
-		return err
+		return "", err
 	}
 	now := time.Now().UnixMilli()
 	id := core.NewNodeID()
-	_, err = tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, url, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?)`,
-		id, op.ParentID, string(core.KindBookmark), op.Title, op.URL, ord, now, now)
-	return err
+	_, err = tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, url, canonical_url, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?)`,
+		id, op.ParentID, string(core.KindBookmark), op.Title, op.URL, s.canonicalURL(&op.URL), ord, now, now)
+	return id, err
+}
+
+func (s *Store) applyAddSeparator(ctx context.Context, tx *sql.Tx, op core.AddSeparatorOp) (string, error) {
+	ord, err := s.calcOrd(ctx, tx, op.ParentID, op.Index)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UnixMilli()
+	id := core.NewNodeID()
+	_, err = tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, ord, created_at, updated_at) VALUES(?,?,?,'',?,?,?)`,
+		id, op.ParentID, string(core.KindSeparator), ord, now, now)
+	return id, err
+}
+
+func (s *Store) applyAddSmartFolder(ctx context.Context, tx *sql.Tx, op core.AddSmartFolderOp) (string, error) {
+	ord, err := s.calcOrd(ctx, tx, op.ParentID, op.Index)
+	if err != nil {
+		return "", err
+	}
+	query, err := encodeQuery(&op.Query)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UnixMilli()
+	id := core.NewNodeID()
+	_, err = tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, query, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?)`,
+		id, op.ParentID, string(core.KindSmart), op.Title, query, ord, now, now)
+	return id, err
 }
 
 func (s *Store) applyRename(ctx context.Context, tx *sql.Tx, op core.RenameNodeOp) error {
@@ -250,93 +645,470 @@ func (s *Store) applyMove(ctx context.Context, tx *sql.Tx, op core.MoveNodeOp) e
 		return err
 	}
 	res, err := tx.ExecContext(ctx, `UPDATE nodes SET parent_id = ?, ord = ?, updated_at = ? WHERE id = ?`, op.NewParentID, ord, time.Now().UnixMilli(), op.NodeID)
+	if err := wrapRowsAffected(res, err); err != nil {
+		return err
+	}
+	// Moving a node out of the trash by hand forgets where it came from.
+	_, err = tx.ExecContext(ctx, `DELETE FROM trash_entries WHERE node_id = ?`, op.NodeID)
+	return err
+}
+
+func (s *Store) applyDelete(ctx context.Context, tx *sql.Tx, op core.DeleteNodeOp) error {
+	if op.Soft {
+		trashed, err := s.inTrash(ctx, tx, op.NodeID)
+		if err != nil {
+			return err
+		}
+		if !trashed {
+			return s.applyTrash(ctx, tx, op)
+		}
+	}
+	if !op.Recursive {
+		var hasChildren bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM nodes WHERE parent_id = ?)`, op.NodeID).Scan(&hasChildren); err != nil {
+			return err
+		}
+		if hasChildren {
+			return core.ErrFolderNotEmpty
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM nodes WHERE id = ?`, op.NodeID)
+		return wrapRowsAffected(res, err)
+	}
+	res, err := tx.ExecContext(ctx, `
+		WITH RECURSIVE sub(id) AS (
+			SELECT ?
+			UNION ALL
+			SELECT n.id FROM nodes n JOIN sub s ON n.parent_id = s.id
+		)
+		DELETE FROM nodes WHERE id IN (SELECT id FROM sub);
+	`, op.NodeID)
 	return wrapRowsAffected(res, err)
 }
 
-func (s *Store) applyDelete(ctx context.Context, tx *sql.Tx, id string) error {
-	res, err := tx.ExecContext(ctx, `DELETE FROM nodes WHERE id = ?`, id)
+// applyTrash moves a node under the trash folder, remembering its original
+// parent and sibling index so it can be restored later.
+func (s *Store) applyTrash(ctx context.Context, tx *sql.Tx, op core.DeleteNodeOp) error {
+	var (
+		parentID *string
+		ord      float64
+	)
+	if err := tx.QueryRowContext(ctx, `SELECT parent_id, ord FROM nodes WHERE id = ?`, op.NodeID).Scan(&parentID, &ord); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no rows affected")
+		}
+		return err
+	}
+	if parentID == nil {
+		return core.ErrRootImmutable
+	}
+	if !op.Recursive {
+		var hasChildren bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM nodes WHERE parent_id = ?)`, op.NodeID).Scan(&hasChildren); err != nil {
+			return err
+		}
+		if hasChildren {
+			return core.ErrFolderNotEmpty
+		}
+	}
+	var index int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM nodes WHERE parent_id = ? AND (ord < ? OR (ord = ? AND id < ?))`,
+		*parentID, ord, ord, op.NodeID).Scan(&index); err != nil {
+		return err
+	}
+	trashOrd, err := s.calcOrd(ctx, tx, core.TrashID, nil)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	if _, err := tx.ExecContext(ctx, `UPDATE nodes SET parent_id = ?, ord = ?, updated_at = ? WHERE id = ?`, core.TrashID, trashOrd, now, op.NodeID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO trash_entries(node_id, orig_parent_id, orig_index, deleted_at) VALUES(?,?,?,?)`,
+		op.NodeID, *parentID, index, now)
+	return err
+}
+
+func (s *Store) applyRestore(ctx context.Context, tx *sql.Tx, op core.RestoreNodeOp) error {
+	var (
+		parentID   *string
+		origParent sql.NullString
+		origIndex  sql.NullInt64
+	)
+	err := tx.QueryRowContext(ctx, `
+		SELECT n.parent_id, t.orig_parent_id, t.orig_index
+		FROM nodes n LEFT JOIN trash_entries t ON t.node_id = n.id
+		WHERE n.id = ?`, op.NodeID).Scan(&parentID, &origParent, &origIndex)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return core.ErrInvalidNode
+		}
+		return err
+	}
+	if parentID == nil || *parentID != core.TrashID {
+		return core.ErrNotTrashed
+	}
+	target := op.ParentID
+	if target == "" {
+		target = "root"
+		if origParent.Valid {
+			ok, err := s.isRestorableParent(ctx, tx, origParent.String)
+			if err != nil {
+				return err
+			}
+			if ok {
+				target = origParent.String
+			}
+		}
+	}
+	index := op.Index
+	if index == nil && origIndex.Valid && target == origParent.String {
+		idx := int(origIndex.Int64)
+		index = &idx
+	}
+	ord, err := s.calcOrd(ctx, tx, target, index)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE nodes SET parent_id = ?, ord = ?, updated_at = ? WHERE id = ?`, target, ord, time.Now().UnixMilli(), op.NodeID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM trash_entries WHERE node_id = ?`, op.NodeID)
+	return err
+}
+
+// isRestorableParent reports whether id is an existing folder outside the trash.
+func (s *Store) isRestorableParent(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	var kind string
+	err := tx.QueryRowContext(ctx, `SELECT kind FROM nodes WHERE id = ?`, id).Scan(&kind)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if kind != string(core.KindFolder) {
+		return false, nil
+	}
+	trashed, err := s.inTrash(ctx, tx, id)
+	return !trashed, err
+}
+
+// inTrash reports whether id is the trash folder or one of its descendants.
+func (s *Store) inTrash(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	var found bool
+	err := tx.QueryRowContext(ctx, `
+		WITH RECURSIVE anc(id, parent_id) AS (
+			SELECT id, parent_id FROM nodes WHERE id = ?
+			UNION ALL
+			SELECT n.id, n.parent_id FROM nodes n JOIN anc a ON n.id = a.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM anc WHERE id = ?)`, id, core.TrashID).Scan(&found)
+	return found, err
+}
+
+// EmptyTrash permanently deletes everything in the trash and returns the
+// number of top-level trashed nodes removed.
+func (s *Store) EmptyTrash(ctx context.Context) (int, error) {
+	return s.deleteTrashed(ctx, OriginEmptyTrash, `SELECT id FROM nodes WHERE parent_id = ?`, core.TrashID)
+}
+
+// PurgeTrash permanently deletes trashed nodes deleted before cutoff and
+// returns how many top-level trashed nodes were removed.
+func (s *Store) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	return s.deleteTrashed(ctx, OriginPurgeTrash, `
+		SELECT id FROM nodes
+		WHERE parent_id = ?
+		  AND id IN (SELECT node_id FROM trash_entries WHERE deleted_at < ?)`, core.TrashID, cutoff.UnixMilli())
+}
+
+// deleteTrashed recursively deletes the trashed nodes selected by query and
+// logs the deletes under origin.
+func (s *Store) deleteTrashed(ctx context.Context, origin, query string, args ...any) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	ops := make([]core.Op, 0, len(ids))
+	for _, id := range ids {
+		op := core.DeleteNodeOp{NodeID: id, Recursive: true}
+		if err := s.applyDelete(ctx, tx, op); err != nil {
+			return 0, err
+		}
+		ops = append(ops, op)
+	}
+	if _, err := s.appendOpLog(ctx, tx, "", origin, ops, make([]string, len(ops))); err != nil {
+		return 0, err
+	}
+	if err := bumpTreeVersion(ctx, tx); err != nil {
+		return 0, err
+	}
+	return len(ops), tx.Commit()
+}
+
+// bumpTreeVersion advances the monotonic tree version reported by LoadTree.
+// Every transaction that changes nodes calls it before committing.
+func bumpTreeVersion(ctx context.Context, tx *sql.Tx) error {
+	res, err := tx.ExecContext(ctx, `UPDATE meta SET value = CAST(value AS INTEGER) + 1 WHERE key = 'treeVersion'`)
 	return wrapRowsAffected(res, err)
 }
 
-func (s *Store) applyUpdateBookmark(ctx context.Context, tx *sql.Tx, op core.UpdateBookmarkOp) error {
-	setClauses := make([]string, 0, 3)
-	args := make([]any, 0, 4)
-	if op.Title != nil {
+func (s *Store) applyUpdate(ctx context.Context, tx *sql.Tx, id string, title, url, notes *string, query *core.SmartQuery) error {
+	setClauses := make([]string, 0, 6)
+	args := make([]any, 0, 7)
+	if title != nil {
 		setClauses = append(setClauses, "title = ?")
-		args = append(args, *op.Title)
+		args = append(args, *title)
+	}
+	if url != nil {
+		setClauses = append(setClauses, "url = ?", "canonical_url = ?")
+		args = append(args, *url, s.canonicalURL(url))
+	}
+	if notes != nil {
+		setClauses = append(setClauses, "notes = ?")
+		args = append(args, *notes)
 	}
-	if op.URL != nil {
-		setClauses = append(setClauses, "url = ?")
-		args = append(args, *op.URL)
+	if query != nil {
+		raw, err := encodeQuery(query)
+		if err != nil {
+			return err
+		}
+		setClauses = append(setClauses, "query = ?")
+		args = append(args, *raw)
 	}
 	if len(setClauses) == 0 {
 		return nil
 	}
 	setClauses = append(setClauses, "updated_at = ?")
-	args = append(args, time.Now().UnixMilli(), op.NodeID)
+	args = append(args, time.Now().UnixMilli(), id)
 	stmt := fmt.Sprintf("UPDATE nodes SET %s WHERE id = ?", strings.Join(setClauses, ", "))
 	res, err := tx.ExecContext(ctx, stmt, args...)
 	return wrapRowsAffected(res, err)
 }
 
-func (s *Store) applySaveSession(ctx context.Context, tx *sql.Tx, op core.SaveSessionOp) error {
+func (s *Store) applyAddTags(ctx context.Context, tx *sql.Tx, op core.AddTagsOp) error {
+	res, err := tx.ExecContext(ctx, `UPDATE nodes SET updated_at = ? WHERE id = ?`, time.Now().UnixMilli(), op.NodeID)
+	if err := wrapRowsAffected(res, err); err != nil {
+		return err
+	}
+	for _, tag := range core.NormalizeTags(op.Tags) {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO node_tags(node_id, tag) VALUES(?,?)`, op.NodeID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) applyRemoveTags(ctx context.Context, tx *sql.Tx, op core.RemoveTagsOp) error {
+	res, err := tx.ExecContext(ctx, `UPDATE nodes SET updated_at = ? WHERE id = ?`, time.Now().UnixMilli(), op.NodeID)
+	if err := wrapRowsAffected(res, err); err != nil {
+		return err
+	}
+	for _, tag := range core.NormalizeTags(op.Tags) {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM node_tags WHERE node_id = ? AND tag = ?`, op.NodeID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) applySaveSession(ctx context.Context, tx *sql.Tx, op core.SaveSessionOp) (string, error) {
 	ord, err := s.calcOrd(ctx, tx, op.ParentID, op.Index)
 	if err != nil {
-		return err
+		return "", err
 	}
 	now := time.Now().UnixMilli()
 	folderID := core.NewNodeID()
 	if _, err := tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?)`,
 		folderID, op.ParentID, string(core.KindFolder), op.Title, ord, now, now); err != nil {
-		return err
+		return "", err
 	}
 	for idx, tab := range op.Tabs {
 		childOrd := float64(idx)
-		if _, err := tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, url, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?)`,
-			core.NewNodeID(), folderID, string(core.KindBookmark), tab.Title, tab.URL, childOrd, now, now); err != nil {
-			return err
+		if _, err := tx.ExecContext(ctx, `INSERT INTO nodes(id, parent_id, kind, title, url, canonical_url, ord, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?)`,
+			core.NewNodeID(), folderID, string(core.KindBookmark), tab.Title, tab.URL, s.canonicalURL(&tab.URL), childOrd, now, now); err != nil {
+			return "", err
 		}
 	}
-	return nil
+	return folderID, nil
 }
 
 func (s *Store) calcOrd(ctx context.Context, tx *sql.Tx, parentID string, index *int) (float64, error) {
-	rows, err := tx.QueryContext(ctx, `SELECT ord FROM nodes WHERE parent_id = ? ORDER BY ord ASC`, parentID)
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM nodes WHERE parent_id = ?`, parentID).Scan(&count); err != nil {
+		return 0, err
+	}
+	pos := count
+	if index != nil {
+		pos = *index
+		if pos < 0 {
+			pos = 0
+		}
+		if pos > count {
+			pos = count
+		}
+	}
+	switch {
+	case count == 0:
+		return 0, nil
+	case pos == 0:
+		var first float64
+		err := tx.QueryRowContext(ctx, `SELECT MIN(ord) FROM nodes WHERE parent_id = ?`, parentID).Scan(&first)
+		return core.PrevOrd(first), err
+	case pos == count:
+		var last float64
+		err := tx.QueryRowContext(ctx, `SELECT MAX(ord) FROM nodes WHERE parent_id = ?`, parentID).Scan(&last)
+		return core.NextOrd(last), err
+	}
+	lo, hi, err := s.neighbourOrds(ctx, tx, parentID, pos)
 	if err != nil {
 		return 0, err
 	}
+	if core.NeedsRebalance(lo, hi) {
+		if err := s.rebalance(ctx, tx, parentID); err != nil {
+			return 0, err
+		}
+		lo, hi = float64(pos-1), float64(pos)
+	}
+	return core.Midpoint(lo, hi), nil
+}
+
+// neighbourOrds returns the ords of the siblings at positions pos-1 and pos.
+func (s *Store) neighbourOrds(ctx context.Context, tx *sql.Tx, parentID string, pos int) (float64, float64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT ord FROM nodes WHERE parent_id = ? ORDER BY ord ASC, id ASC LIMIT 2 OFFSET ?`, parentID, pos-1)
+	if err != nil {
+		return 0, 0, err
+	}
 	defer rows.Close()
 	var ords []float64
 	for rows.Next() {
 		var ord float64
 		if err := rows.Scan(&ord); err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 		ords = append(ords, ord)
 	}
 	if err := rows.Err(); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	pos := len(ords)
-	if index != nil {
-		pos = *index
-		if pos < 0 {
-			pos = 0
+	if len(ords) != 2 {
+		return 0, 0, fmt.Errorf("expected neighbours at position %d under %s", pos, parentID)
+	}
+	return ords[0], ords[1], nil
+}
+
+// applySortChildren rewrites the ords of the op's folder, and with Recursive
+// of every folder below it, to evenly spaced integers in sorted order.
+func (s *Store) applySortChildren(ctx context.Context, tx *sql.Tx, op core.SortChildrenOp) error {
+	folders := []string{op.NodeID}
+	if op.Recursive {
+		rows, err := tx.QueryContext(ctx, `
+			WITH RECURSIVE sub(id) AS (
+				SELECT id FROM nodes WHERE parent_id = ? AND kind = 'folder'
+				UNION ALL
+				SELECT n.id FROM nodes n JOIN sub ON n.parent_id = sub.id WHERE n.kind = 'folder'
+			)
+			SELECT id FROM sub`, op.NodeID)
+		if err != nil {
+			return err
 		}
-		if pos > len(ords) {
-			pos = len(ords)
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			folders = append(folders, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
 		}
 	}
-	switch {
-	case len(ords) == 0:
-		return 0, nil
-	case pos == 0:
-		return ords[0] - 1, nil
-	case pos == len(ords):
-		return ords[len(ords)-1] + 1, nil
-	default:
-		return (ords[pos-1] + ords[pos]) / 2, nil
+	stmt, err := tx.PrepareContext(ctx, `UPDATE nodes SET ord = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, folder := range folders {
+		rows, err := tx.QueryContext(ctx, `SELECT `+nodeColumns+` FROM nodes WHERE parent_id = ? ORDER BY ord ASC, id ASC`, folder)
+		if err != nil {
+			return err
+		}
+		var children []core.Node
+		for rows.Next() {
+			node, err := scanNode(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			children = append(children, node)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		core.SortNodes(children, op)
+		for i, child := range children {
+			if _, err := stmt.ExecContext(ctx, float64(i), child.ID); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// rebalance renumbers a folder's children to evenly spaced integer ords,
+// preserving their current order.
+func (s *Store) rebalance(ctx context.Context, tx *sql.Tx, parentID string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM nodes WHERE parent_id = ? ORDER BY ord ASC, id ASC`, parentID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `UPDATE nodes SET ord = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, id := range ids {
+		if _, err := stmt.ExecContext(ctx, float64(i), id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func wrapRowsAffected(res sql.Result, err error) error {
@@ -2,8 +2,16 @@ package sqlite
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rexliu/s0f/pkg/core"
 )
@@ -24,12 +32,14 @@ func TestStoreApplyOps(t *testing.T) {
 		core.AddFolderOp{ParentID: "root", Title: "Projects"},
 		core.AddBookmarkOp{ParentID: "root", Title: "Example", URL: "https://example.com"},
 	}
-	tree, err := store.ApplyOps(ctx, ops)
+	res, err := store.ApplyOps(ctx, ops, ApplyOptions{})
 	if err != nil {
 		t.Fatalf("apply ops: %v", err)
 	}
-	if len(tree.Nodes) != 3 {
-		t.Fatalf("expected 3 nodes, got %d", len(tree.Nodes))
+	tree := res.Tree
+	// root and trash system folders plus the two inserted nodes.
+	if len(tree.Nodes) != 4 {
+		t.Fatalf("expected 4 nodes, got %d", len(tree.Nodes))
 	}
 
 	folderID, bookmarkID := findByTitle(tree, "Projects"), findByTitle(tree, "Example")
@@ -37,23 +47,1380 @@ func TestStoreApplyOps(t *testing.T) {
 		t.Fatal("missing inserted nodes")
 	}
 
-	moveTree, err := store.ApplyOps(ctx, []core.Op{
+	moveRes, err := store.ApplyOps(ctx, []core.Op{
 		core.MoveNodeOp{NodeID: bookmarkID, NewParentID: folderID},
-	})
+	}, ApplyOptions{})
 	if err != nil {
 		t.Fatalf("move apply: %v", err)
 	}
+	moveTree := moveRes.Tree
 	parent := moveTree.Nodes[bookmarkID].ParentID
 	if parent == nil || *parent != folderID {
 		t.Fatalf("expected bookmark parent %s, got %v", folderID, parent)
 	}
 }
 
-func findByTitle(tree core.Tree, title string) string {
-	for id, node := range tree.Nodes {
-		if node.Title == title {
-			return id
+func TestStoreResolvesTempIDs(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Sprint", TempID: "tmp-folder"},
+		core.AddBookmarkOp{ParentID: "tmp-folder", Title: "Board", URL: "https://board.example", TempID: "tmp-board"},
+		core.AddTagsOp{NodeID: "tmp-board", Tags: []string{"planning"}},
+		core.SaveSessionOp{ParentID: "tmp-folder", Title: "Tabs", TempID: "tmp-session", Tabs: []core.Tab{{Title: "One", URL: "https://one.example"}}},
+		core.MoveNodeOp{NodeID: "tmp-board", NewParentID: "tmp-session"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	folderID, boardID, sessionID := res.TempIDs["tmp-folder"], res.TempIDs["tmp-board"], res.TempIDs["tmp-session"]
+	if folderID == "" || boardID == "" || sessionID == "" {
+		t.Fatalf("expected all temp ids mapped, got %v", res.TempIDs)
+	}
+	if got := res.Tree.Nodes[sessionID].ParentID; got == nil || *got != folderID {
+		t.Fatalf("expected session under %s, got %v", folderID, got)
+	}
+	board := res.Tree.Nodes[boardID]
+	if board.ParentID == nil || *board.ParentID != sessionID || len(board.Tags) != 1 {
+		t.Fatalf("unexpected board node %+v", board)
+	}
+}
+
+func TestStoreTags(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "Cluster", URL: "https://k8s.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	tree := res.Tree
+	id := findByTitle(tree, "Cluster")
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.AddTagsOp{NodeID: id, Tags: []string{"Infra", "k8s", "infra"}},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+	tree = res.Tree
+	if got := tree.Nodes[id].Tags; len(got) != 2 || got[0] != "infra" || got[1] != "k8s" {
+		t.Fatalf("unexpected tags %v", got)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.RemoveTagsOp{NodeID: id, Tags: []string{"INFRA"}},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("remove tags: %v", err)
+	}
+	tree = res.Tree
+	if got := tree.Nodes[id].Tags; len(got) != 1 || got[0] != "k8s" {
+		t.Fatalf("unexpected tags %v", got)
+	}
+
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: id}}, ApplyOptions{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	var count int
+	if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM node_tags`).Scan(&count); err != nil {
+		t.Fatalf("count tags: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected tags to cascade on delete, found %d", count)
+	}
+}
+
+func TestStoreNotes(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Research"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Paper", URL: "https://paper.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	tree := res.Tree
+	folderID, bookmarkID := findByTitle(tree, "Research"), findByTitle(tree, "Paper")
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.UpdateBookmarkOp{NodeID: bookmarkID, Notes: strPtr("cited in design review")},
+		core.UpdateFolderOp{NodeID: folderID, Notes: strPtr("reading list for Q3")},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("update notes: %v", err)
+	}
+	tree = res.Tree
+	if got := tree.Nodes[bookmarkID].Notes; got != "cited in design review" {
+		t.Fatalf("unexpected bookmark notes %q", got)
+	}
+	if got := tree.Nodes[folderID].Notes; got != "reading list for Q3" {
+		t.Fatalf("unexpected folder notes %q", got)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.UpdateBookmarkOp{NodeID: bookmarkID, Notes: strPtr("")},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("clear notes: %v", err)
+	}
+	tree = res.Tree
+	if got := tree.Nodes[bookmarkID]; got.Notes != "" || got.Title != "Paper" {
+		t.Fatalf("expected notes cleared and title kept, got %+v", got)
+	}
+}
+
+func TestStoreMigratesV1Schema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	v1 := []string{
+		`CREATE TABLE meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);`,
+		`INSERT INTO meta(key,value) VALUES ('schemaVersion','1');`,
+		`CREATE TABLE nodes (
+			id TEXT PRIMARY KEY,
+			parent_id TEXT REFERENCES nodes(id) ON DELETE CASCADE,
+			kind TEXT NOT NULL CHECK (kind IN ('folder','bookmark')),
+			title TEXT NOT NULL,
+			url TEXT,
+			ord REAL NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		);`,
+		`INSERT INTO nodes VALUES ('root', NULL, 'folder', 'Root', NULL, 0, 0, 0);`,
+		`INSERT INTO nodes VALUES ('bm', 'root', 'bookmark', 'Old', 'https://old.example', 0, 0, 0);`,
+		`CREATE TABLE node_tags (
+			node_id TEXT NOT NULL REFERENCES nodes(id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (node_id, tag)
+		);`,
+		`INSERT INTO node_tags VALUES ('bm', 'keep');`,
+	}
+	for _, stmt := range v1 {
+		if _, err := raw.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("seed v1: %v", err)
 		}
 	}
-	return ""
+	raw.Close()
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("schema version: %v", err)
+	}
+	if version != migrations[len(migrations)-1].version {
+		t.Fatalf("expected latest schema version, got %d", version)
+	}
+	tree, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	if node, ok := tree.Nodes["bm"]; !ok || node.Title != "Old" || node.Notes != "" {
+		t.Fatalf("expected migrated bookmark, got %+v", node)
+	}
+	// The nodes table rebuild must not cascade into dependent tables.
+	if tags := tree.Nodes["bm"].Tags; len(tags) != 1 || tags[0] != "keep" {
+		t.Fatalf("expected tags to survive migration, got %v", tags)
+	}
+}
+
+func TestStoreSeparators(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "A", URL: "https://a.example"},
+		core.AddBookmarkOp{ParentID: "root", Title: "B", URL: "https://b.example"},
+		core.AddSeparatorOp{ParentID: "root", Index: intPtr(1), TempID: "sep"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	sepID := res.TempIDs["sep"]
+	sep := res.Tree.Nodes[sepID]
+	if sep.Kind != core.KindSeparator || sep.Title != "" || sep.URL != nil {
+		t.Fatalf("unexpected separator %+v", sep)
+	}
+	if got := res.Tree.Children["root"][1]; got != sepID {
+		t.Fatalf("expected separator at index 1, got %s", got)
+	}
+}
+
+func TestStoreSmartFolders(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddSmartFolderOp{ParentID: "root", Title: "k8s", Query: core.SmartQuery{Tags: []string{"k8s"}}, TempID: "smart"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	smartID := res.TempIDs["smart"]
+
+	if _, err := store.ApplyOps(ctx, []core.Op{
+		core.UpdateFolderOp{NodeID: smartID, Query: &core.SmartQuery{Text: "cluster", Tags: []string{"k8s"}}},
+	}, ApplyOptions{}); err != nil {
+		t.Fatalf("update query: %v", err)
+	}
+	tree, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	smart := tree.Nodes[smartID]
+	if smart.Kind != core.KindSmart || smart.Query == nil || smart.Query.Text != "cluster" || len(smart.Query.Tags) != 1 {
+		t.Fatalf("unexpected smart folder %+v", smart)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	if q := res.Tree.Nodes[smartID].Query; q == nil || q.Text != "" || q.Tags[0] != "k8s" {
+		t.Fatalf("expected original query after undo, got %+v", q)
+	}
+}
+
+func TestStoreCanonicalURLs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "A", URL: "https://Example.com/a/?utm_source=x", TempID: "a"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	id := res.TempIDs["a"]
+	if got := res.Tree.Nodes[id].CanonicalURL; got == nil || *got != "https://example.com/a" {
+		t.Fatalf("unexpected canonical url %v", got)
+	}
+	store.Close()
+
+	// Reopening under different rules recomputes stored canonical URLs.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	rules := core.DefaultURLRules()
+	rules.TrailingSlash = core.TrailingSlashKeep
+	store.SetURLRules(rules)
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	tree, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	if got := tree.Nodes[id].CanonicalURL; got == nil || *got != "https://example.com/a/" {
+		t.Fatalf("expected recomputed canonical url, got %v", got)
+	}
+}
+
+func TestStoreMergeDuplicates(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Work", TempID: "work"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Old", URL: "https://example.com/a/", TempID: "old"},
+		core.AddBookmarkOp{ParentID: "work", Title: "Deep", URL: "https://Example.com/a?utm_source=x", TempID: "deep"},
+		core.AddTagsOp{NodeID: "deep", Tags: []string{"k8s"}},
+		core.AddBookmarkOp{ParentID: "work", Title: "Other", URL: "https://other.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	oldID, deepID := res.TempIDs["old"], res.TempIDs["deep"]
+
+	groups, version, err := store.FindDuplicates(ctx)
+	if err != nil {
+		t.Fatalf("find duplicates: %v", err)
+	}
+	if len(groups) != 1 || groups[0].CanonicalURL != "https://example.com/a" || len(groups[0].NodeIDs) != 2 {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+	if version != res.Tree.Version {
+		t.Fatalf("expected groups read at version %s, got %s", res.Tree.Version, version)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.MergeDuplicatesOp{NodeIDs: groups[0].NodeIDs, Strategy: core.MergeOldest},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if _, ok := res.Tree.Nodes[deepID]; ok {
+		t.Fatalf("expected duplicate %s deleted", deepID)
+	}
+	if tags := res.Tree.Nodes[oldID].Tags; len(tags) != 1 || tags[0] != "k8s" {
+		t.Fatalf("expected survivor to inherit tags, got %v", tags)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	if _, ok := res.Tree.Nodes[deepID]; !ok {
+		t.Fatalf("expected %s restored by undo", deepID)
+	}
+	if tags := res.Tree.Nodes[oldID].Tags; len(tags) != 0 {
+		t.Fatalf("expected survivor tags reverted, got %v", tags)
+	}
+}
+
+func TestStoreSortChildren(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "charlie", URL: "https://c.example"},
+		core.AddFolderOp{ParentID: "root", Title: "Sub", TempID: "sub"},
+		core.AddBookmarkOp{ParentID: "sub", Title: "Zulu", URL: "https://z.example"},
+		core.AddBookmarkOp{ParentID: "sub", Title: "yankee", URL: "https://y.example"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Alpha", URL: "https://a.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	subID := res.TempIDs["sub"]
+	titles := func(tree core.Tree, parent string) string {
+		out := ""
+		for _, id := range tree.Children[parent] {
+			out += tree.Nodes[id].Title + ","
+		}
+		return out
+	}
+	before := titles(res.Tree, "root")
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.SortChildrenOp{NodeID: "root", By: core.SortByTitle, KindFirst: true, Recursive: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("sort: %v", err)
+	}
+	if got := titles(res.Tree, "root"); got != "Sub,Alpha,charlie," {
+		t.Fatalf("unexpected root order %s", got)
+	}
+	if got := titles(res.Tree, subID); got != "yankee,Zulu," {
+		t.Fatalf("unexpected sub order %s", got)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	if got := titles(res.Tree, "root"); got != before {
+		t.Fatalf("expected undo to restore %s, got %s", before, got)
+	}
+}
+
+func TestStoreCopyNode(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Projects", TempID: "projects"},
+		core.AddFolderOp{ParentID: "projects", Title: "Infra", TempID: "infra"},
+		core.AddBookmarkOp{ParentID: "infra", Title: "Docs", URL: "https://docs.example", TempID: "docs"},
+		core.AddTagsOp{NodeID: "docs", Tags: []string{"ref"}},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	projectsID, infraID := res.TempIDs["projects"], res.TempIDs["infra"]
+	before := len(res.Tree.Nodes)
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.CopyNodeOp{NodeID: projectsID, NewParentID: infraID, TempID: "copy"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("copy into own subtree: %v", err)
+	}
+	tree := res.Tree
+	copyID := res.TempIDs["copy"]
+	if copyID == "" || copyID == projectsID || *tree.Nodes[copyID].ParentID != infraID {
+		t.Fatalf("unexpected copy %q", copyID)
+	}
+	if len(tree.Nodes) != before+3 {
+		t.Fatalf("expected 3 copied nodes, got %d", len(tree.Nodes)-before)
+	}
+	infraCopy := tree.Children[copyID][0]
+	if infraCopy == infraID || tree.Nodes[infraCopy].Title != "Infra" || len(tree.Children[infraCopy]) != 1 {
+		t.Fatalf("unexpected copied folder %+v", tree.Nodes[infraCopy])
+	}
+	docsCopy := tree.Nodes[tree.Children[infraCopy][0]]
+	if docsCopy.ID == res.TempIDs["docs"] || docsCopy.URL == nil || *docsCopy.URL != "https://docs.example" ||
+		docsCopy.CanonicalURL == nil || len(docsCopy.Tags) != 1 || docsCopy.Tags[0] != "ref" {
+		t.Fatalf("unexpected copied bookmark %+v", docsCopy)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	if len(res.Tree.Nodes) != before {
+		t.Fatalf("expected undo to remove the copy, got %d nodes", len(res.Tree.Nodes))
+	}
+}
+
+func TestStoreReplace(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Wiki", TempID: "wiki"},
+		core.AddBookmarkOp{ParentID: "wiki", Title: "Wiki home", URL: "https://wiki.old.example/home", TempID: "home"},
+		core.AddBookmarkOp{ParentID: "wiki", Title: "Runbooks", URL: "https://wiki.old.example/runbooks", TempID: "runbooks"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Trashed", URL: "https://wiki.old.example/trashed", TempID: "trashed"},
+		core.DeleteNodeOp{NodeID: "trashed", Soft: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	homeID, trashedID := res.TempIDs["home"], res.TempIDs["trashed"]
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.ReplaceOp{NodeID: "root", Find: "wiki.old.example", Replace: "wiki.new.example", DryRun: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if got := *res.Tree.Nodes[homeID].URL; got != "https://wiki.old.example/home" {
+		t.Fatalf("dry run changed url to %s", got)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.ReplaceOp{NodeID: "root", Find: `^https://wiki\.old\.example/(.*)$`, Replace: "https://wiki.new.example/$1", Regex: true, Fields: []core.ReplaceField{core.ReplaceURL}},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	home := res.Tree.Nodes[homeID]
+	if *home.URL != "https://wiki.new.example/home" || home.CanonicalURL == nil || *home.CanonicalURL != "https://wiki.new.example/home" {
+		t.Fatalf("unexpected rewritten bookmark %+v", home)
+	}
+	if home.Title != "Wiki home" {
+		t.Fatalf("expected title untouched, got %q", home.Title)
+	}
+	if got := *res.Tree.Nodes[trashedID].URL; got != "https://wiki.old.example/trashed" {
+		t.Fatalf("expected trash to be skipped, got %s", got)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	if got := *res.Tree.Nodes[homeID].URL; got != "https://wiki.old.example/home" {
+		t.Fatalf("expected undo to restore url, got %s", got)
+	}
+}
+
+func TestStoreMergeFolders(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Project", TempID: "target"},
+		core.AddBookmarkOp{ParentID: "target", Title: "Spec", URL: "https://spec.example", TempID: "spec"},
+		core.AddBookmarkOp{ParentID: "target", Title: "Board", URL: "https://board.example"},
+		core.AddFolderOp{ParentID: "root", Title: "Project (old)", TempID: "source"},
+		core.AddBookmarkOp{ParentID: "source", Title: "Spec again", URL: "https://SPEC.example/?utm_source=mail", TempID: "dup"},
+		core.AddTagsOp{NodeID: "dup", Tags: []string{"design"}},
+		core.AddFolderOp{ParentID: "source", Title: "Notes"},
+		core.AddBookmarkOp{ParentID: "source", Title: "Wiki", URL: "https://wiki.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	targetID, sourceID, specID, dupID := res.TempIDs["target"], res.TempIDs["source"], res.TempIDs["spec"], res.TempIDs["dup"]
+	before := len(res.Tree.Nodes)
+	titles := func(tree core.Tree, parent string) string {
+		out := ""
+		for _, id := range tree.Children[parent] {
+			out += tree.Nodes[id].Title + ","
+		}
+		return out
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.MergeFoldersOp{SourceID: sourceID, TargetID: targetID, Dedupe: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("merge folders: %v", err)
+	}
+	tree := res.Tree
+	if _, ok := tree.Nodes[sourceID]; ok {
+		t.Fatalf("expected source folder to be removed")
+	}
+	if _, ok := tree.Nodes[dupID]; ok {
+		t.Fatalf("expected duplicate bookmark to be removed")
+	}
+	if got := titles(tree, targetID); got != "Spec,Board,Notes,Wiki," {
+		t.Fatalf("unexpected merged order %s", got)
+	}
+	if spec := tree.Nodes[specID]; len(spec.Tags) != 1 || spec.Tags[0] != "design" {
+		t.Fatalf("expected duplicate's tags on kept bookmark, got %v", spec.Tags)
+	}
+
+	entry, err := store.NextUndo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next undo: %v", err)
+	}
+	res, err = store.Undo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	tree = res.Tree
+	if len(tree.Nodes) != before || titles(tree, sourceID) != "Spec again,Notes,Wiki," || titles(tree, targetID) != "Spec,Board," {
+		t.Fatalf("expected undo to restore both folders, got %s / %s", titles(tree, sourceID), titles(tree, targetID))
+	}
+	if len(tree.Nodes[specID].Tags) != 0 {
+		t.Fatalf("expected undo to drop copied tags, got %v", tree.Nodes[specID].Tags)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.MergeFoldersOp{SourceID: sourceID, TargetID: targetID, Interleave: true, Soft: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("interleave merge: %v", err)
+	}
+	if got := titles(res.Tree, targetID); got != "Spec,Spec again,Board,Notes,Wiki," {
+		t.Fatalf("unexpected interleaved order %s", got)
+	}
+	if parent := res.Tree.Nodes[sourceID].ParentID; parent == nil || *parent != core.TrashID {
+		t.Fatalf("expected soft merge to trash the source")
+	}
+}
+
+func TestStoreDeleteRecursive(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{core.AddFolderOp{ParentID: "root", Title: "Projects"}}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	tree := res.Tree
+	folderID := findByTitle(tree, "Projects")
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: folderID, Title: "Infra"},
+		core.AddBookmarkOp{ParentID: folderID, Title: "Docs", URL: "https://docs.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply children: %v", err)
+	}
+	tree = res.Tree
+
+	_, err = store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: folderID}}, ApplyOptions{})
+	if !errors.Is(err, core.ErrFolderNotEmpty) {
+		t.Fatalf("expected ErrFolderNotEmpty, got %v", err)
+	}
+	tree, err = store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	if len(tree.Nodes) != 5 {
+		t.Fatalf("expected failed delete to keep subtree, got %d nodes", len(tree.Nodes))
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: folderID, Recursive: true}}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("recursive delete: %v", err)
+	}
+	tree = res.Tree
+	if len(tree.Nodes) != 2 {
+		t.Fatalf("expected only system folders to remain, got %d nodes", len(tree.Nodes))
+	}
+}
+
+func TestStoreTrashAndRestore(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Projects"},
+		core.AddBookmarkOp{ParentID: "root", Title: "A", URL: "https://a.example"},
+		core.AddBookmarkOp{ParentID: "root", Title: "B", URL: "https://b.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	tree := res.Tree
+	folderID, bID := findByTitle(tree, "Projects"), findByTitle(tree, "B")
+	if _, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: folderID, Title: "Child", URL: "https://child.example"},
+	}, ApplyOptions{}); err != nil {
+		t.Fatalf("add child: %v", err)
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{
+		core.DeleteNodeOp{NodeID: folderID, Recursive: true, Soft: true},
+		core.DeleteNodeOp{NodeID: bID, Soft: true},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	tree = res.Tree
+	if got := tree.Children[core.TrashID]; len(got) != 2 {
+		t.Fatalf("expected 2 trashed nodes, got %v", got)
+	}
+	info := tree.Nodes[folderID].Trashed
+	if info == nil || info.ParentID != "root" || info.Index != 0 {
+		t.Fatalf("unexpected trash info %+v", info)
+	}
+	if len(tree.Children[folderID]) != 1 {
+		t.Fatal("expected trashed folder to keep its children")
+	}
+
+	res, err = store.ApplyOps(ctx, []core.Op{core.RestoreNodeOp{NodeID: folderID}}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	tree = res.Tree
+	if first := tree.Children["root"][0]; first != folderID {
+		t.Fatalf("expected folder restored at index 0, got %s first", first)
+	}
+	if tree.Nodes[folderID].Trashed != nil {
+		t.Fatal("expected trash info cleared after restore")
+	}
+
+	if removed, err := store.PurgeTrash(ctx, time.Now().Add(-time.Hour)); err != nil || removed != 0 {
+		t.Fatalf("expected nothing purged yet, got %d (%v)", removed, err)
+	}
+	if removed, err := store.PurgeTrash(ctx, time.Now().Add(time.Hour)); err != nil || removed != 1 {
+		t.Fatalf("expected one purged node, got %d (%v)", removed, err)
+	}
+	tree, err = store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	if _, ok := tree.Nodes[bID]; ok {
+		t.Fatal("expected purged bookmark to be gone")
+	}
+
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: folderID, Recursive: true, Soft: true}}, ApplyOptions{}); err != nil {
+		t.Fatalf("soft delete again: %v", err)
+	}
+	if removed, err := store.EmptyTrash(ctx); err != nil || removed != 1 {
+		t.Fatalf("expected one emptied node, got %d (%v)", removed, err)
+	}
+	tree, err = store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	// root, trash, and bookmark A.
+	if len(tree.Nodes) != 3 {
+		t.Fatalf("expected emptied trash to drop subtree, got %d nodes", len(tree.Nodes))
+	}
+}
+
+func TestStoreUndoRedo(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Work", TempID: "work"},
+		core.AddBookmarkOp{ParentID: "work", Title: "Docs", URL: "https://docs.example", TempID: "docs"},
+		core.AddTagsOp{NodeID: "docs", Tags: []string{"ref"}},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	folderID, docsID := res.TempIDs["work"], res.TempIDs["docs"]
+	before := res.Tree.Nodes[docsID]
+	if _, err := store.ApplyOps(ctx, []core.Op{core.RenameNodeOp{NodeID: docsID, Title: "Manual"}}, ApplyOptions{}); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: folderID, Recursive: true}}, ApplyOptions{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	undo := func() core.Tree {
+		t.Helper()
+		entry, err := store.NextUndo(ctx)
+		if err != nil || entry == nil {
+			t.Fatalf("next undo: %v (entry %v)", err, entry)
+		}
+		tree, err := store.LoadTree(ctx)
+		if err != nil {
+			t.Fatalf("load tree: %v", err)
+		}
+		if err := core.ValidateOps(tree, entry.Inverse, core.DefaultValidationPolicy()); err != nil {
+			t.Fatalf("validate undo: %v", err)
+		}
+		res, err := store.Undo(ctx, *entry, ApplyOptions{})
+		if err != nil {
+			t.Fatalf("undo: %v", err)
+		}
+		return res.Tree
+	}
+
+	tree := undo()
+	docs, ok := tree.Nodes[docsID]
+	if !ok || docs.Title != "Manual" || *docs.ParentID != folderID {
+		t.Fatalf("expected deleted subtree restored, got %+v", docs)
+	}
+	if len(docs.Tags) != 1 || docs.Tags[0] != "ref" || docs.Ord != before.Ord {
+		t.Fatalf("expected tags and ord restored, got %+v", docs)
+	}
+
+	tree = undo()
+	if got := tree.Nodes[docsID].Title; got != "Docs" {
+		t.Fatalf("expected title reverted, got %q", got)
+	}
+
+	entry, err := store.NextRedo(ctx)
+	if err != nil || entry == nil {
+		t.Fatalf("next redo: %v (entry %v)", err, entry)
+	}
+	res, err = store.Redo(ctx, *entry, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("redo: %v", err)
+	}
+	if got := res.Tree.Nodes[docsID].Title; got != "Manual" {
+		t.Fatalf("expected rename redone, got %q", got)
+	}
+
+	if _, err := store.ApplyOps(ctx, []core.Op{core.AddFolderOp{ParentID: "root", Title: "Other"}}, ApplyOptions{}); err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	if entry, err := store.NextRedo(ctx); err != nil || entry != nil {
+		t.Fatalf("expected new batch to clear redo, got %v (%v)", entry, err)
+	}
+
+	undo()
+	undo()
+	tree = undo()
+	// Only root and trash remain once the first batch is undone.
+	if len(tree.Nodes) != 2 {
+		t.Fatalf("expected all batches undone, got %d nodes", len(tree.Nodes))
+	}
+	if entry, err := store.NextUndo(ctx); err != nil || entry != nil {
+		t.Fatalf("expected empty undo stack, got %v (%v)", entry, err)
+	}
+}
+
+func TestStoreOpLog(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Inbox", TempID: "inbox"},
+		core.AddBookmarkOp{ParentID: "inbox", Title: "Go", URL: "https://go.dev"},
+	}, ApplyOptions{Client: "chrome-extension"})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	folderID := res.TempIDs["inbox"]
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: folderID, Recursive: true, Soft: true}}, ApplyOptions{Client: "macos"}); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if _, err := store.EmptyTrash(ctx); err != nil {
+		t.Fatalf("empty trash: %v", err)
+	}
+
+	entries, err := store.OpLog(ctx, 0, 2)
+	if err != nil {
+		t.Fatalf("op log: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected first page of 2 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.BatchID != res.BatchID || first.Client != "chrome-extension" || first.Origin != OriginApply {
+		t.Fatalf("unexpected first entry %+v", first)
+	}
+	add, ok := first.Ops[1].(core.AddBookmarkOp)
+	if !ok || add.ParentID != folderID {
+		t.Fatalf("expected logged ops with temp IDs resolved, got %#v", first.Ops[1])
+	}
+	if first.CreatedIDs[0] != folderID || first.CreatedIDs[1] == "" {
+		t.Fatalf("unexpected created IDs %v", first.CreatedIDs)
+	}
+
+	rest, err := store.OpLog(ctx, entries[1].Seq, 10)
+	if err != nil {
+		t.Fatalf("op log: %v", err)
+	}
+	if len(rest) != 1 || rest[0].Origin != OriginEmptyTrash {
+		t.Fatalf("expected empty_trash entry on second page, got %+v", rest)
+	}
+	del, ok := rest[0].Ops[0].(core.DeleteNodeOp)
+	if !ok || del.NodeID != folderID || !del.Recursive {
+		t.Fatalf("expected logged recursive delete, got %#v", rest[0].Ops[0])
+	}
+}
+
+func TestStoreLoadSubtree(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddFolderOp{ParentID: "root", Title: "Work", TempID: "work"},
+		core.AddFolderOp{ParentID: "work", Title: "Infra", TempID: "infra"},
+		core.AddBookmarkOp{ParentID: "infra", Title: "Grafana", URL: "https://grafana.example"},
+		core.AddBookmarkOp{ParentID: "work", Title: "Wiki", URL: "https://wiki.example", TempID: "wiki"},
+		core.AddTagsOp{NodeID: "wiki", Tags: []string{"docs"}},
+		core.AddFolderOp{ParentID: "root", Title: "Home"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	workID, infraID, wikiID := res.TempIDs["work"], res.TempIDs["infra"], res.TempIDs["wiki"]
+
+	sub, err := store.LoadSubtree(ctx, workID, 1)
+	if err != nil {
+		t.Fatalf("load subtree: %v", err)
+	}
+	tree := sub.Tree
+	if tree.RootID != workID || tree.Version != res.Tree.Version || len(tree.Nodes) != 3 {
+		t.Fatalf("expected work and its 2 children at version %s, got %+v", res.Tree.Version, tree)
+	}
+	if got := tree.Children[workID]; len(got) != 2 || got[0] != infraID || got[1] != wikiID {
+		t.Fatalf("unexpected children %v", got)
+	}
+	if len(tree.Children[infraID]) != 0 || sub.ChildCounts[infraID] != 1 || sub.ChildCounts[workID] != 2 {
+		t.Fatalf("expected infra's child counted but not loaded, got %v", sub.ChildCounts)
+	}
+	if tags := tree.Nodes[wikiID].Tags; len(tags) != 1 || tags[0] != "docs" {
+		t.Fatalf("expected wiki tags, got %v", tags)
+	}
+
+	sub, err = store.LoadSubtree(ctx, workID, -1)
+	if err != nil {
+		t.Fatalf("load whole subtree: %v", err)
+	}
+	if len(sub.Tree.Nodes) != 4 || len(sub.Tree.Children[infraID]) != 1 {
+		t.Fatalf("expected the whole subtree, got %+v", sub.Tree)
+	}
+	if _, err := store.LoadSubtree(ctx, "missing", 1); !errors.Is(err, core.ErrInvalidNode) {
+		t.Fatalf("expected ErrInvalidNode for a missing root, got %v", err)
+	}
+}
+
+func TestStoreLoadChildren(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	ops := []core.Op{core.AddFolderOp{ParentID: "root", Title: "Inbox", TempID: "inbox"}}
+	for i := 0; i < 5; i++ {
+		ops = append(ops, core.AddBookmarkOp{ParentID: "inbox", Title: fmt.Sprintf("B%d", i), URL: fmt.Sprintf("https://b%d.example", i)})
+	}
+	res, err := store.ApplyOps(ctx, ops, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	inboxID := res.TempIDs["inbox"]
+	want := res.Tree.Children[inboxID]
+
+	page, err := store.LoadChildren(ctx, inboxID, "", 2)
+	if err != nil {
+		t.Fatalf("load first page: %v", err)
+	}
+	if page.Total != 5 || page.Version != res.Tree.Version || page.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	var got []string
+	for _, node := range page.Nodes {
+		got = append(got, node.ID)
+	}
+	// A sibling removed before the cursor must not shift later pages.
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: want[0]}}, ApplyOptions{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	for pages := 1; page.NextCursor != ""; pages++ {
+		if pages > 2 {
+			t.Fatalf("expected 3 pages, still paging after %v", got)
+		}
+		page, err = store.LoadChildren(ctx, inboxID, page.NextCursor, 2)
+		if err != nil {
+			t.Fatalf("load children: %v", err)
+		}
+		for _, node := range page.Nodes {
+			got = append(got, node.ID)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected children %v, got %v", want, got)
+	}
+
+	// Sorting renumbers every ord; the next page still starts after the
+	// cursor's sibling in its new position.
+	page, err = store.LoadChildren(ctx, inboxID, "", 3)
+	if err != nil {
+		t.Fatalf("load first page: %v", err)
+	}
+	if _, err := store.ApplyOps(ctx, []core.Op{core.SortChildrenOp{NodeID: inboxID, By: core.SortByTitle, Descending: true}}, ApplyOptions{}); err != nil {
+		t.Fatalf("sort children: %v", err)
+	}
+	sorted, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	order := sorted.Children[inboxID]
+	last := page.Nodes[len(page.Nodes)-1].ID
+	want = append([]string(nil), order[indexOfID(order, last)+1:]...)
+	got = nil
+	for pages := 1; page.NextCursor != ""; pages++ {
+		if pages > 2 {
+			t.Fatalf("expected at most 3 pages, still paging after %v", got)
+		}
+		page, err = store.LoadChildren(ctx, inboxID, page.NextCursor, 2)
+		if err != nil {
+			t.Fatalf("load children after sort: %v", err)
+		}
+		for _, node := range page.Nodes {
+			got = append(got, node.ID)
+		}
+	}
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected children after %s in sorted order %v, got %v", last, want, got)
+	}
+
+	page, err = store.LoadChildren(ctx, "root", "", 10)
+	if err != nil {
+		t.Fatalf("load root children: %v", err)
+	}
+	if len(page.Nodes) != 1 || page.NextCursor != "" || page.ChildCounts[inboxID] != 4 {
+		t.Fatalf("expected root children with inbox count 4, got %+v", page)
+	}
+	if _, err := store.LoadChildren(ctx, inboxID, "bogus", 2); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := store.LoadChildren(ctx, "missing", "", 2); !errors.Is(err, core.ErrInvalidNode) {
+		t.Fatalf("expected ErrInvalidNode for a missing parent, got %v", err)
+	}
+}
+
+func TestStoreTreeVersion(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	tree, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	if tree.Version != "0" {
+		t.Fatalf("expected fresh store at version 0, got %q", tree.Version)
+	}
+	res, err := store.ApplyOps(ctx, []core.Op{core.AddFolderOp{ParentID: "root", Title: "A", TempID: "a"}}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	if res.Tree.Version != "1" {
+		t.Fatalf("expected version 1 after a batch, got %q", res.Tree.Version)
+	}
+	if _, err := store.EmptyTrash(ctx); err != nil {
+		t.Fatalf("empty trash: %v", err)
+	}
+	if tree, _ := store.LoadTree(ctx); tree.Version != "1" {
+		t.Fatalf("expected no-op empty trash to keep version 1, got %q", tree.Version)
+	}
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: res.TempIDs["a"], Soft: true}}, ApplyOptions{}); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if _, err := store.EmptyTrash(ctx); err != nil {
+		t.Fatalf("empty trash: %v", err)
+	}
+	if tree, _ := store.LoadTree(ctx); tree.Version != "3" {
+		t.Fatalf("expected version 3 after delete and empty trash, got %q", tree.Version)
+	}
+}
+
+func TestStoreRebalancesCollapsedOrds(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+
+	const inserts = 2000
+	ops := []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "first", URL: "https://first.example"},
+		core.AddBookmarkOp{ParentID: "root", Title: "last", URL: "https://last.example"},
+	}
+	one := 1
+	for i := 0; i < inserts; i++ {
+		ops = append(ops, core.AddBookmarkOp{ParentID: "root", Title: fmt.Sprintf("n%04d", i), URL: "https://n.example", Index: &one})
+	}
+	res, err := store.ApplyOps(ctx, ops, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	tree := res.Tree
+
+	children := tree.Children["root"]
+	if len(children) != inserts+2 {
+		t.Fatalf("expected %d children, got %d", inserts+2, len(children))
+	}
+	want := []string{"first"}
+	for i := inserts - 1; i >= 0; i-- {
+		want = append(want, fmt.Sprintf("n%04d", i))
+	}
+	want = append(want, "last")
+	for i, id := range children {
+		if got := tree.Nodes[id].Title; got != want[i] {
+			t.Fatalf("position %d: expected %s, got %s", i, want[i], got)
+		}
+		if i > 0 && tree.Nodes[children[i-1]].Ord >= tree.Nodes[id].Ord {
+			t.Fatalf("ords not strictly increasing at position %d", i)
+		}
+	}
+
+	// Order must also survive a reopen of the database.
+	path := store.Path()
+	store.Close()
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	again, err := reopened.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	for i, id := range again.Children["root"] {
+		if again.Nodes[id].Title != want[i] {
+			t.Fatalf("after reopen position %d: expected %s, got %s", i, want[i], again.Nodes[id].Title)
+		}
+	}
+}
+
+func TestCacheStoreFavicons(t *testing.T) {
+	ctx := context.Background()
+	cache, err := OpenCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	if err := cache.Init(ctx); err != nil {
+		t.Fatalf("init cache: %v", err)
+	}
+
+	icon, err := cache.PutFavicon(ctx, Favicon{Origin: "HTTPS://Go.dev:443/doc/", ContentType: "image/png", Data: []byte("png1"), FetchedAt: 1})
+	if err != nil {
+		t.Fatalf("put favicon: %v", err)
+	}
+	if icon.Origin != "https://go.dev" {
+		t.Fatalf("expected normalized origin, got %q", icon.Origin)
+	}
+	if _, err := cache.PutFavicon(ctx, Favicon{Origin: "https://go.dev/blog", ContentType: "image/svg+xml", Data: []byte("svg"), FetchedAt: 2}); err != nil {
+		t.Fatalf("replace favicon: %v", err)
+	}
+	if _, err := cache.PutFavicon(ctx, Favicon{Origin: "https://a.example", ContentType: "text/html", Data: []byte("<html>")}); !errors.Is(err, ErrInvalidFavicon) {
+		t.Fatalf("expected ErrInvalidFavicon for a non-image, got %v", err)
+	}
+	if _, err := cache.PutFavicon(ctx, Favicon{Origin: "javascript:alert(1)", ContentType: "image/png", Data: []byte("png")}); !errors.Is(err, core.ErrInvalidURL) {
+		t.Fatalf("expected ErrInvalidURL for a URL without origin, got %v", err)
+	}
+
+	icons, err := cache.Favicons(ctx, []string{"https://go.dev", "https://a.example"})
+	if err != nil {
+		t.Fatalf("favicons: %v", err)
+	}
+	got, ok := icons["https://go.dev"]
+	if len(icons) != 1 || !ok || got.ContentType != "image/svg+xml" || string(got.Data) != "svg" || got.FetchedAt != 2 {
+		t.Fatalf("expected the replaced go.dev icon only, got %+v", icons)
+	}
+}
+
+func TestCacheStoreVisits(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+	cache, err := OpenCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	if err := cache.Init(ctx); err != nil {
+		t.Fatalf("init cache: %v", err)
+	}
+
+	res, err := store.ApplyOps(ctx, []core.Op{
+		core.AddBookmarkOp{ParentID: "root", Title: "Go", URL: "https://go.dev/", TempID: "a"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Go again", URL: "HTTPS://GO.DEV?utm_source=x", TempID: "b"},
+		core.AddBookmarkOp{ParentID: "root", Title: "Other", URL: "https://other.example"},
+	}, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply ops: %v", err)
+	}
+	ids, err := store.BookmarksByURL(ctx, "https://go.dev")
+	if err != nil {
+		t.Fatalf("bookmarks by url: %v", err)
+	}
+	want := []string{res.TempIDs["a"], res.TempIDs["b"]}
+	sort.Strings(want)
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("expected both go.dev bookmarks %v, got %v", want, ids)
+	}
+
+	if err := cache.RecordVisit(ctx, ids, 200); err != nil {
+		t.Fatalf("record visit: %v", err)
+	}
+	// An older visit reported late still counts but keeps the latest time.
+	if err := cache.RecordVisit(ctx, ids[:1], 100); err != nil {
+		t.Fatalf("record late visit: %v", err)
+	}
+	visits, err := cache.Visits(ctx, append([]string{"unvisited"}, ids...))
+	if err != nil {
+		t.Fatalf("visits: %v", err)
+	}
+	if len(visits) != 2 || visits[ids[0]] != (Visit{Count: 2, LastVisitAt: 200}) || visits[ids[1]] != (Visit{Count: 1, LastVisitAt: 200}) {
+		t.Fatalf("unexpected visits %+v", visits)
+	}
+
+	// A trashed bookmark no longer counts visits to its URL.
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: ids[0], Soft: true}}, ApplyOptions{}); err != nil {
+		t.Fatalf("trash bookmark: %v", err)
+	}
+	trashed, err := store.BookmarksByURL(ctx, "https://go.dev")
+	if err != nil {
+		t.Fatalf("bookmarks by url after trash: %v", err)
+	}
+	if !reflect.DeepEqual(trashed, ids[1:]) {
+		t.Fatalf("expected only %v outside the trash, got %v", ids[1:], trashed)
+	}
+
+	// Once it is deleted outright, pruning drops its visits.
+	if _, err := store.ApplyOps(ctx, []core.Op{core.DeleteNodeOp{NodeID: ids[0]}}, ApplyOptions{}); err != nil {
+		t.Fatalf("delete bookmark: %v", err)
+	}
+	tree, err := store.LoadTree(ctx)
+	if err != nil {
+		t.Fatalf("load tree: %v", err)
+	}
+	removed, err := cache.PruneVisits(ctx, func(id string) bool {
+		_, ok := tree.Nodes[id]
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("prune visits: %v", err)
+	}
+	visits, err = cache.Visits(ctx, ids)
+	if err != nil {
+		t.Fatalf("visits after prune: %v", err)
+	}
+	if removed != 1 || len(visits) != 1 || visits[ids[1]] != (Visit{Count: 1, LastVisitAt: 200}) {
+		t.Fatalf("expected only %s left after pruning %d, got %+v", ids[1], removed, visits)
+	}
+}
+
+// TestDiffRoundTrip checks that core.Diff between two trees, validated and
+// applied to the first, reproduces the second, over random edit histories.
+func TestDiffRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	policy := core.DefaultValidationPolicy()
+	for seed := int64(1); seed <= 30; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		store := openTestStore(t)
+		edit := func(n int) core.Tree {
+			for i := 0; i < n; i++ {
+				tree, err := store.LoadTree(ctx)
+				if err != nil {
+					t.Fatalf("seed %d: load tree: %v", seed, err)
+				}
+				op := randomOp(rng, tree, i)
+				if core.ValidateOps(tree, []core.Op{op}, policy) != nil {
+					continue
+				}
+				if _, err := store.ApplyOps(ctx, []core.Op{op}, ApplyOptions{}); err != nil {
+					t.Fatalf("seed %d: apply %s: %v", seed, core.OpType(op), err)
+				}
+			}
+			tree, err := store.LoadTree(ctx)
+			if err != nil {
+				t.Fatalf("seed %d: load tree: %v", seed, err)
+			}
+			return tree
+		}
+		apply := func(from, to core.Tree) core.Tree {
+			ops := core.Diff(from, to)
+			if err := core.ValidateOps(from, ops, policy); err != nil {
+				t.Fatalf("seed %d: diff does not validate: %v", seed, err)
+			}
+			if len(ops) == 0 {
+				return from
+			}
+			res, err := store.ApplyOps(ctx, ops, ApplyOptions{})
+			if err != nil {
+				t.Fatalf("seed %d: apply diff: %v", seed, err)
+			}
+			return res.Tree
+		}
+
+		old := edit(60)
+		next := edit(40)
+		got := apply(next, old)
+		if treeShape(got) != treeShape(old) {
+			t.Fatalf("seed %d: diff back to old\n got: %s\nwant: %s", seed, treeShape(got), treeShape(old))
+		}
+		if ops := core.Diff(got, got); len(ops) != 0 {
+			t.Fatalf("seed %d: expected no ops for an unchanged tree, got %d", seed, len(ops))
+		}
+		got = apply(got, next)
+		if treeShape(got) != treeShape(next) {
+			t.Fatalf("seed %d: diff forward to new\n got: %s\nwant: %s", seed, treeShape(got), treeShape(next))
+		}
+	}
+}
+
+// randomOp returns a random edit of tree. It may be invalid; callers skip
+// those.
+func randomOp(rng *rand.Rand, tree core.Tree, i int) core.Op {
+	var folders, nodes []string
+	for id, node := range tree.Nodes {
+		if id == "root" || id == core.TrashID {
+			continue
+		}
+		nodes = append(nodes, id)
+		if node.Kind == core.KindFolder && !core.IsTrashed(tree, id) {
+			folders = append(folders, id)
+		}
+	}
+	sort.Strings(nodes)
+	sort.Strings(folders)
+	folders = append(folders, "root")
+	folder := folders[rng.Intn(len(folders))]
+	index := rng.Intn(len(tree.Children[folder]) + 1)
+	if len(nodes) == 0 {
+		return core.AddFolderOp{ParentID: folder, Title: "Folder"}
+	}
+	node := tree.Nodes[nodes[rng.Intn(len(nodes))]]
+	name := fmt.Sprintf("n%d", i)
+	switch rng.Intn(10) {
+	case 0, 1:
+		return core.AddFolderOp{ParentID: folder, Title: name, Index: &index}
+	case 2, 3:
+		return core.AddBookmarkOp{ParentID: folder, Title: name, URL: "https://" + name + ".example", Index: &index}
+	case 4:
+		return core.AddSeparatorOp{ParentID: folder, Index: &index}
+	case 5:
+		return core.MoveNodeOp{NodeID: node.ID, NewParentID: folder, NewIndex: &index}
+	case 6:
+		if node.Kind == core.KindBookmark {
+			url, notes := "https://"+name+".example/moved", "notes "+name
+			return core.UpdateBookmarkOp{NodeID: node.ID, URL: &url, Notes: &notes}
+		}
+		return core.RenameNodeOp{NodeID: node.ID, Title: name}
+	case 7:
+		if rng.Intn(2) == 0 {
+			return core.AddTagsOp{NodeID: node.ID, Tags: []string{fmt.Sprintf("t%d", rng.Intn(3))}}
+		}
+		return core.RemoveTagsOp{NodeID: node.ID, Tags: []string{fmt.Sprintf("t%d", rng.Intn(3))}}
+	case 8:
+		return core.DeleteNodeOp{NodeID: node.ID, Recursive: true, Soft: true}
+	default:
+		return core.DeleteNodeOp{NodeID: node.ID, Recursive: true}
+	}
+}
+
+// treeShape renders a tree without IDs or timestamps: the live tree in order,
+// then the trash with siblings sorted, since Diff does not reproduce order
+// there.
+func treeShape(tree core.Tree) string {
+	var shape func(id string, sorted bool) string
+	shape = func(id string, sorted bool) string {
+		node := tree.Nodes[id]
+		out := fmt.Sprintf("%s:%q", node.Kind, node.Title)
+		if node.URL != nil {
+			out += fmt.Sprintf(" <%s>", *node.URL)
+		}
+		if node.Notes != "" {
+			out += fmt.Sprintf(" notes=%q", node.Notes)
+		}
+		if len(node.Tags) > 0 {
+			out += fmt.Sprintf(" tags=%v", node.Tags)
+		}
+		var children []string
+		for _, child := range tree.Children[id] {
+			children = append(children, shape(child, sorted))
+		}
+		if sorted {
+			sort.Strings(children)
+		}
+		if len(children) > 0 {
+			out += " [" + strings.Join(children, ", ") + "]"
+		}
+		return out
+	}
+	return shape("root", false) + " " + shape(core.TrashID, true)
+}
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return store
+}
+
+func findByTitle(tree core.Tree, title string) string {
+	for id, node := range tree.Nodes {
+		if node.Title == title {
+			return id
+		}
+	}
+	return ""
+}
+
+func indexOfID(ids []string, id string) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
 }
@@ -0,0 +1,311 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// ErrInvalidCursor indicates a LoadChildren cursor that LoadChildren did not
+// return.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Subtree is the part of the tree below one node that LoadSubtree read.
+type Subtree struct {
+	// Tree holds the loaded nodes; its RootID is the subtree's root.
+	Tree core.Tree
+	// ChildCounts gives the number of children of every loaded node that
+	// has any, including nodes at the depth limit whose children were not
+	// loaded.
+	ChildCounts map[string]int
+}
+
+// subtreeIDs selects the IDs of a node and its descendants down to a depth
+// limit, walking idx_nodes_parent_ord one level at a time. Its parameters are
+// the root ID and the depth limit twice; a negative limit means no limit.
+const subtreeIDs = `
+	WITH RECURSIVE sub(id, depth) AS (
+		SELECT id, 0 FROM nodes WHERE id = ?
+		UNION ALL
+		SELECT n.id, sub.depth + 1 FROM nodes n JOIN sub ON n.parent_id = sub.id
+		WHERE ? < 0 OR sub.depth < ?
+	)
+	SELECT id FROM sub`
+
+// LoadSubtree returns rootID and its descendants at most depth levels below
+// it; a negative depth loads the whole subtree. Unlike LoadTree it reads only
+// the rows it returns.
+func (s *Store) LoadSubtree(ctx context.Context, rootID string, depth int) (Subtree, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Subtree{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+nodeColumns+`
+		FROM nodes
+		WHERE id IN (`+subtreeIDs+`)
+		ORDER BY parent_id, ord, id`, rootID, depth, depth)
+	if err != nil {
+		return Subtree{}, err
+	}
+	nodes := make(map[string]core.Node)
+	children := make(map[string][]string)
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			rows.Close()
+			return Subtree{}, err
+		}
+		nodes[node.ID] = node
+		if node.ParentID != nil && node.ID != rootID {
+			children[*node.ParentID] = append(children[*node.ParentID], node.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Subtree{}, err
+	}
+	if _, ok := nodes[rootID]; !ok {
+		return Subtree{}, core.ErrInvalidNode
+	}
+	args := []any{rootID, depth, depth}
+	if err := loadNodeDetails(ctx, tx, nodes, subtreeIDs, args...); err != nil {
+		return Subtree{}, err
+	}
+	counts, err := childCounts(ctx, tx, subtreeIDs, args...)
+	if err != nil {
+		return Subtree{}, err
+	}
+	version, err := readTreeVersion(ctx, tx)
+	if err != nil {
+		return Subtree{}, err
+	}
+	return Subtree{
+		Tree: core.Tree{
+			Version:  version,
+			RootID:   rootID,
+			Nodes:    nodes,
+			Children: children,
+		},
+		ChildCounts: counts,
+	}, nil
+}
+
+// ChildrenPage is one page of a folder's children as LoadChildren returns it.
+type ChildrenPage struct {
+	Version string
+	// Nodes are the children in sibling order.
+	Nodes []core.Node
+	// Total is the number of children the folder has across all pages.
+	Total int
+	// ChildCounts gives the number of children of each node in Nodes that
+	// has any.
+	ChildCounts map[string]int
+	// NextCursor continues after the last node in Nodes; it is empty on the
+	// last page.
+	NextCursor string
+}
+
+// LoadChildren returns up to limit children of parentID in sibling order,
+// starting after cursor, which is "" for the first page or a NextCursor from
+// an earlier page. A cursor names the last sibling returned rather than an
+// offset, and each page starts after that sibling's current position, so
+// paging stays consistent when siblings are added, removed, or reordered by
+// sort_children, merge_folders, or an ord rebalance. If the sibling has
+// since left the folder, the page starts after the position it had.
+func (s *Store) LoadChildren(ctx context.Context, parentID, cursor string, limit int) (ChildrenPage, error) {
+	afterOrd, afterID, err := parseChildCursor(cursor)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	defer tx.Rollback()
+
+	var total int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM nodes WHERE parent_id = ?`, parentID).Scan(&total); err != nil {
+		return ChildrenPage{}, err
+	}
+	if total == 0 {
+		var exists int
+		err := tx.QueryRowContext(ctx, `SELECT 1 FROM nodes WHERE id = ?`, parentID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ChildrenPage{}, core.ErrInvalidNode
+		}
+		if err != nil {
+			return ChildrenPage{}, err
+		}
+	}
+	if cursor != "" {
+		var ord float64
+		err := tx.QueryRowContext(ctx, `SELECT ord FROM nodes WHERE id = ? AND parent_id = ?`, afterID, parentID).Scan(&ord)
+		switch {
+		case err == nil:
+			afterOrd = ord
+		case !errors.Is(err, sql.ErrNoRows):
+			return ChildrenPage{}, err
+		}
+	}
+	pageIDs := `SELECT id FROM nodes WHERE parent_id = ?`
+	args := []any{parentID}
+	if cursor != "" {
+		pageIDs += ` AND ord >= ? AND (ord > ? OR id > ?)`
+		args = append(args, afterOrd, afterOrd, afterID)
+	}
+	// One extra row tells whether another page follows.
+	pageIDs += ` ORDER BY ord, id LIMIT ?`
+	args = append(args, limit+1)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+nodeColumns+`
+		FROM nodes
+		WHERE id IN (`+pageIDs+`)
+		ORDER BY ord, id`, args...)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	nodes := make(map[string]core.Node)
+	var order []string
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			rows.Close()
+			return ChildrenPage{}, err
+		}
+		nodes[node.ID] = node
+		order = append(order, node.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ChildrenPage{}, err
+	}
+	if err := loadNodeDetails(ctx, tx, nodes, pageIDs, args...); err != nil {
+		return ChildrenPage{}, err
+	}
+	counts, err := childCounts(ctx, tx, pageIDs, args...)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	version, err := readTreeVersion(ctx, tx)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	page := ChildrenPage{Version: version, Total: total, ChildCounts: counts}
+	if len(order) > limit {
+		order = order[:limit]
+		last := nodes[order[limit-1]]
+		page.NextCursor = strconv.FormatFloat(last.Ord, 'g', -1, 64) + ":" + last.ID
+	}
+	page.Nodes = make([]core.Node, 0, len(order))
+	for _, id := range order {
+		page.Nodes = append(page.Nodes, nodes[id])
+	}
+	return page, nil
+}
+
+// parseChildCursor splits a LoadChildren cursor into the ID of the last
+// sibling already returned and the ord it had then.
+func parseChildCursor(cursor string) (float64, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	rawOrd, id, ok := strings.Cut(cursor, ":")
+	if !ok || id == "" {
+		return 0, "", ErrInvalidCursor
+	}
+	ord, err := strconv.ParseFloat(rawOrd, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return ord, id, nil
+}
+
+// loadNodeDetails fills in the tags and trash entries of nodes, which are the
+// rows idQuery selects.
+func loadNodeDetails(ctx context.Context, tx *sql.Tx, nodes map[string]core.Node, idQuery string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT node_id, tag FROM node_tags
+		WHERE node_id IN (`+idQuery+`)
+		ORDER BY node_id, tag`, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			rows.Close()
+			return err
+		}
+		if node, ok := nodes[id]; ok {
+			node.Tags = append(node.Tags, tag)
+			nodes[id] = node
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT node_id, orig_parent_id, orig_index, deleted_at FROM trash_entries
+		WHERE node_id IN (`+idQuery+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   string
+			info core.TrashInfo
+		)
+		if err := rows.Scan(&id, &info.ParentID, &info.Index, &info.DeletedAt); err != nil {
+			return err
+		}
+		if node, ok := nodes[id]; ok {
+			node.Trashed = &info
+			nodes[id] = node
+		}
+	}
+	return rows.Err()
+}
+
+// childCounts returns the number of children of each node idQuery selects,
+// omitting nodes without children.
+func childCounts(ctx context.Context, tx *sql.Tx, idQuery string, args ...any) (map[string]int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT parent_id, COUNT(*) FROM nodes
+		WHERE parent_id IN (`+idQuery+`)
+		GROUP BY parent_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			id    string
+			count int
+		)
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+	return counts, rows.Err()
+}
+
+func readTreeVersion(ctx context.Context, tx *sql.Tx) (string, error) {
+	var version string
+	if err := tx.QueryRowContext(ctx, `SELECT value FROM meta WHERE key = 'treeVersion'`).Scan(&version); err != nil {
+		return "", fmt.Errorf("read tree version: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,94 @@
+package sqlite
+
+import (
+	"context"
+
+	"github.com/rexliu/s0f/pkg/core"
+)
+
+// canonicalURL normalizes raw under the store's URL rules, returning nil for
+// a nil or unparseable URL.
+func (s *Store) canonicalURL(raw *string) *string {
+	if raw == nil {
+		return nil
+	}
+	canonical, err := core.NormalizeURL(*raw, s.urlRules)
+	if err != nil {
+		return nil
+	}
+	return &canonical
+}
+
+// canonicalizeURLs recomputes canonical_url for every bookmark whose stored
+// value no longer matches the current rules, covering rows written before
+// the column existed or under different rules. Canonical URLs are derived
+// data, so the tree version is left alone.
+func (s *Store) canonicalizeURLs(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id, url, canonical_url FROM nodes WHERE url IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	stale := make(map[string]*string)
+	for rows.Next() {
+		var (
+			id, url   string
+			canonical *string
+		)
+		if err := rows.Scan(&id, &url, &canonical); err != nil {
+			rows.Close()
+			return err
+		}
+		want := s.canonicalURL(&url)
+		if (want == nil) != (canonical == nil) || (want != nil && *want != *canonical) {
+			stale[id] = want
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, canonical := range stale {
+		if _, err := tx.ExecContext(ctx, `UPDATE nodes SET canonical_url = ? WHERE id = ?`, canonical, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BookmarksByURL returns the IDs of the bookmarks outside the trash whose
+// canonical URL is that of raw under the store's rules, in ID order.
+func (s *Store) BookmarksByURL(ctx context.Context, raw string) ([]string, error) {
+	canonical, err := core.NormalizeURL(raw, s.urlRules)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		WITH RECURSIVE trashed(id) AS (
+			SELECT ?
+			UNION ALL
+			SELECT n.id FROM nodes n JOIN trashed t ON n.parent_id = t.id
+		)
+		SELECT id FROM nodes
+		WHERE kind = 'bookmark'
+		  AND canonical_url = ?
+		  AND id NOT IN (SELECT id FROM trashed)
+		ORDER BY id`, core.TrashID, canonical)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}